@@ -1,7 +1,11 @@
 package database
 
 import (
+	"fmt"
+	"time"
+
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/samber/lo"
 	"gorm.io/gorm"
 )
 
@@ -10,16 +14,111 @@ var AutoMaintainRange = []any{
 	&models.Attachment{},
 	&models.AttachmentFragment{},
 	&models.AttachmentBoost{},
+	&models.AttachmentQuota{},
+	&models.AttachmentWebhook{},
+	&models.AttachmentWebhookDelivery{},
+	&models.Job{},
 	&models.StickerPack{},
 	&models.Sticker{},
 }
 
 func RunMigration(source *gorm.DB) error {
+	// The job queue is new, the unfinished attachments were picked up by the boot-time scan before it
+	needAnalyzeBackfill := !source.Migrator().HasTable(&models.Job{})
+
 	if err := source.AutoMigrate(
 		AutoMaintainRange...,
 	); err != nil {
 		return err
 	}
 
-	return nil
+	if needAnalyzeBackfill {
+		if err := backfillAnalyzeJobs(source); err != nil {
+			return err
+		}
+	}
+
+	if err := createAttachmentContentIndex(source); err != nil {
+		return err
+	}
+
+	if err := backfillPerceptualHashBands(source); err != nil {
+		return err
+	}
+
+	return backfillAttachmentStatus(source)
+}
+
+// backfillPerceptualHashBands splits the perceptual hashes computed before the bands existed
+// The shift is arithmetic on the negative ones, the mask drops the extended sign bits
+func backfillPerceptualHashBands(source *gorm.DB) error {
+	return source.Model(&models.Attachment{}).
+		Where("perceptual_hash IS NOT NULL AND perceptual_hash_band0 IS NULL").
+		UpdateColumns(map[string]any{
+			"perceptual_hash_band0": gorm.Expr("(perceptual_hash >> 48) & 65535"),
+			"perceptual_hash_band1": gorm.Expr("(perceptual_hash >> 32) & 65535"),
+			"perceptual_hash_band2": gorm.Expr("(perceptual_hash >> 16) & 65535"),
+			"perceptual_hash_band3": gorm.Expr("perceptual_hash & 65535"),
+		}).Error
+}
+
+// createAttachmentContentIndex creates the full text search index of the document contents
+// The expression index cannot be described by the struct tags, so create it by hand
+func createAttachmentContentIndex(source *gorm.DB) error {
+	stmt := &gorm.Statement{DB: source}
+	if err := stmt.Parse(&models.Attachment{}); err != nil {
+		return err
+	}
+	return source.Exec(fmt.Sprintf(
+		"CREATE INDEX IF NOT EXISTS idx_%s_content_text ON %s USING GIN (to_tsvector('simple', content_text))",
+		stmt.Schema.Table, stmt.Schema.Table,
+	)).Error
+}
+
+// backfillAttachmentStatus derives the status of the attachments created before the status field existed
+// The unfinished ones are pending, their jobs were enqueued when the job queue was created
+func backfillAttachmentStatus(source *gorm.DB) error {
+	if err := source.Model(&models.Attachment{}).
+		Where("status IS NULL OR status = ''").
+		Where("is_quarantined = ? AND cleaned_at IS NULL", false).
+		Where("is_analyzed = ? OR (destination = ? AND ref_id IS NULL)", false, models.AttachmentDstTemporary).
+		UpdateColumn("status", models.AttachmentStatusPending).Error; err != nil {
+		return err
+	}
+	return source.Model(&models.Attachment{}).
+		Where("status IS NULL OR status = ''").
+		UpdateColumn("status", gorm.Expr(
+			"CASE WHEN is_quarantined THEN ? WHEN cleaned_at IS NOT NULL THEN ? ELSE ? END",
+			models.AttachmentStatusQuarantined,
+			models.AttachmentStatusDeleted,
+			models.AttachmentStatusReady,
+		)).Error
+}
+
+// backfillAnalyzeJobs enqueues the attachments that haven't finished analyzing or transferring before the job queue existed
+func backfillAnalyzeJobs(source *gorm.DB) error {
+	var pending []uint
+	if err := source.Model(&models.Attachment{}).
+		Where("is_quarantined = ? AND cleaned_at IS NULL", false).
+		Where("is_analyzed = ? OR (destination = ? AND ref_id IS NULL)", false, models.AttachmentDstTemporary).
+		Pluck("id", &pending).Error; err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	jobs := make([]models.Job, 0, len(pending))
+	for _, id := range pending {
+		jobs = append(jobs, models.Job{
+			Type:         models.JobTypeAnalyze,
+			Status:       models.JobStatusPending,
+			Priority:     models.JobPriorityBackground,
+			MaxAttempts:  5,
+			RunAt:        time.Now(),
+			AttachmentID: lo.ToPtr(id),
+		})
+	}
+	return source.CreateInBatches(jobs, 100).Error
 }
@@ -3,6 +3,7 @@ package fs
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -50,3 +51,41 @@ func DownloadFileToLocal(meta models.Attachment, dst int) (string, error) {
 		return "", fmt.Errorf("invalid destination: unsupported protocol %s", dest.Type)
 	}
 }
+
+// OpenFileReader opens the file in the destination as a stream
+// Unlike DownloadFileToLocal, the file content won't be staged on the local disk
+func OpenFileReader(meta models.Attachment, dst int) (io.ReadCloser, error) {
+	destMap := viper.GetStringMap(fmt.Sprintf("destinations.%d", dst))
+
+	var dest models.BaseDestination
+	rawDest, _ := jsoniter.Marshal(destMap)
+	_ = jsoniter.Unmarshal(rawDest, &dest)
+
+	switch dest.Type {
+	case models.DestinationTypeLocal:
+		var destConfigured models.LocalDestination
+		_ = jsoniter.Unmarshal(rawDest, &destConfigured)
+
+		return os.Open(filepath.Join(destConfigured.Path, meta.Uuid))
+	case models.DestinationTypeS3:
+		var destConfigured models.S3Destination
+		_ = jsoniter.Unmarshal(rawDest, &destConfigured)
+
+		client, err := minio.New(destConfigured.Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(destConfigured.SecretID, destConfigured.SecretKey, ""),
+			Secure: destConfigured.EnableSSL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure s3 client: %v", err)
+		}
+
+		object, err := client.GetObject(context.Background(), destConfigured.Bucket, filepath.Join(destConfigured.Path, meta.Uuid), minio.GetObjectOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get file from s3: %v", err)
+		}
+
+		return object, nil
+	default:
+		return nil, fmt.Errorf("invalid destination: unsupported protocol %s", dest.Type)
+	}
+}
@@ -18,6 +18,10 @@ import (
 	"github.com/spf13/viper"
 )
 
+// OnLifecycleCleaned will be called with the attachments marked as clean needed by the pool's lifecycle
+// This package cannot import the services, so the services will set it up while initializing
+var OnLifecycleCleaned func(attachments []models.Attachment)
+
 func RunMarkLifecycleDeletionTask() {
 	var pools []models.AttachmentPool
 	if err := database.C.Find(&pools).Error; err != nil {
@@ -33,30 +37,57 @@ func RunMarkLifecycleDeletionTask() {
 
 	for _, pool := range pendingPools {
 		lifecycle := time.Now().Add(-time.Duration(*pool.Config.Data().ExistLifecycle) * time.Second)
+
+		var attachments []models.Attachment
+		if OnLifecycleCleaned != nil {
+			database.C.
+				Where("pool_id = ?", pool.ID).
+				Where("created_at < ?", lifecycle).
+				Where("cleaned_at IS NULL").
+				Find(&attachments)
+		}
+
 		tx := database.C.
 			Where("pool_id = ?", pool.ID).
 			Where("created_at < ?", lifecycle).
 			Where("cleaned_at IS NULL").
-			Updates(&models.Attachment{CleanedAt: lo.ToPtr(time.Now())})
+			Updates(&models.Attachment{CleanedAt: lo.ToPtr(time.Now()), Status: models.AttachmentStatusDeleted})
 		log.Info().
 			Str("pool", pool.Alias).
 			Int64("count", tx.RowsAffected).
 			Err(tx.Error).
 			Msg("Marking attachments as clean needed due to pool's lifecycle configuration...")
+
+		if tx.Error == nil && len(attachments) > 0 {
+			OnLifecycleCleaned(attachments)
+		}
 	}
 }
 
+// RunMarkMultipartDeletionTask removes the multipart uploads which haven't been touched for a while
+// The unfinished uploads are fragments instead of attachments, so they can be deleted with their chunks directly
 func RunMarkMultipartDeletionTask() {
 	lifecycle := time.Now().Add(-60 * time.Minute)
-	tx := database.C.
-		Where("created_at < ?", lifecycle).
-		Where("is_uploaded = ?", false).
-		Where("cleaned_at IS NULL").
-		Updates(&models.Attachment{CleanedAt: lo.ToPtr(time.Now())})
+
+	var fragments []models.AttachmentFragment
+	if err := database.C.Where("updated_at < ?", lifecycle).Find(&fragments).Error; err != nil {
+		log.Error().Err(err).Msg("Unable to find the outdated multipart uploads...")
+		return
+	} else if len(fragments) == 0 {
+		return
+	}
+
+	for _, fragment := range fragments {
+		_ = DeleteFragment(fragment)
+	}
+
+	tx := database.C.Where("id IN ?", lo.Map(fragments, func(item models.AttachmentFragment, _ int) uint {
+		return item.ID
+	})).Delete(&models.AttachmentFragment{})
 	log.Info().
 		Int64("count", tx.RowsAffected).
 		Err(tx.Error).
-		Msg("Marking attachments as clean needed due to multipart lifecycle...")
+		Msg("Deleting outdated fragments due to multipart lifecycle...")
 }
 
 func RunScheduleDeletionTask() {
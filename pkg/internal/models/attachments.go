@@ -19,6 +19,28 @@ const (
 	AttachmentDstTemporary = 0 // The destination 0 is a reserved config for pre-upload processing
 )
 
+const (
+	AttachmentStatusPending      = "pending"
+	AttachmentStatusAnalyzing    = "analyzing"
+	AttachmentStatusTransferring = "transferring"
+	AttachmentStatusReady        = "ready"
+	AttachmentStatusFailed       = "failed"
+	AttachmentStatusQuarantined  = "quarantined"
+	AttachmentStatusDeleted      = "deleted"
+)
+
+// AttachmentStatusTransitions lists the statuses each status can move to
+// Staying in the same status is always allowed, the jobs may be retried
+var AttachmentStatusTransitions = map[string][]string{
+	AttachmentStatusPending:      {AttachmentStatusAnalyzing, AttachmentStatusFailed, AttachmentStatusDeleted},
+	AttachmentStatusAnalyzing:    {AttachmentStatusTransferring, AttachmentStatusReady, AttachmentStatusFailed, AttachmentStatusQuarantined, AttachmentStatusDeleted},
+	AttachmentStatusTransferring: {AttachmentStatusReady, AttachmentStatusFailed, AttachmentStatusDeleted},
+	AttachmentStatusReady:        {AttachmentStatusDeleted},
+	AttachmentStatusFailed:       {AttachmentStatusPending, AttachmentStatusTransferring, AttachmentStatusDeleted},
+	AttachmentStatusQuarantined:  {AttachmentStatusDeleted},
+	AttachmentStatusDeleted:      {},
+}
+
 const (
 	AttachmentTypeNormal = iota
 	AttachmentTypeThumbnail
@@ -42,11 +64,28 @@ type Attachment struct {
 	RefCount    int    `json:"ref_count"`
 	Type        uint   `json:"type"`
 
-	CleanedAt *time.Time `json:"cleaned_at"`
+	Status        string     `json:"status" gorm:"index"`
+	FailureReason string     `json:"failure_reason"`
+	CleanedAt     *time.Time `json:"cleaned_at"`
 
 	Metadata datatypes.JSONMap `json:"metadata"` // This field is analyzer auto generated metadata
 	Usermeta datatypes.JSONMap `json:"usermeta"` // This field is user set metadata
 
+	PrivateMetadata datatypes.JSONMap `json:"-"` // The fields stripped by the privacy policy of the pool, only visible to the owner
+
+	ContentText string `json:"-" gorm:"type:text"` // The text extracted from the documents, only for searching
+
+	// The dHash of the image or the key frame of the video, the near-duplicates have a small hamming distance
+	PerceptualHash *int64 `json:"perceptual_hash" gorm:"index"`
+	// The 16-bit bands of the perceptual hash from the highest bits, set them via SetPerceptualHash
+	// Two hashes within the distance d have a band within the distance d/4, the indexed bands narrow down the candidates
+	PerceptualHashBand0 *int `json:"-" gorm:"index"`
+	PerceptualHashBand1 *int `json:"-" gorm:"index"`
+	PerceptualHashBand2 *int `json:"-" gorm:"index"`
+	PerceptualHashBand3 *int `json:"-" gorm:"index"`
+	// The dominant color packed as 0xRRGGBB, the readable one is in the metadata, only for filtering and sorting
+	DominantColor *int `json:"-" gorm:"index"`
+
 	ContentRating int `json:"content_rating"` // This field use to filter mature content or not
 	QualityRating int `json:"quality_rating"` // This field use to filter good content or not
 
@@ -54,6 +93,10 @@ type Attachment struct {
 	IsSelfRef   bool `json:"is_self_ref"`
 	IsIndexable bool `json:"is_indexable"` // Show this attachment in the public directory api or not
 
+	IsQuarantined bool       `json:"is_quarantined"` // Infected files will be kept in the temporary storage and cannot be opened
+	ScanVerdict   string     `json:"-"`              // The signature reported by the scanner, only visible to the owner and admins
+	ScannedAt     *time.Time `json:"scanned_at"`
+
 	UsedCount int `json:"used_count"`
 
 	Thumbnail    *Attachment `json:"thumbnail"`
@@ -64,6 +107,10 @@ type Attachment struct {
 	Ref   *Attachment `json:"ref"`
 	RefID *uint       `json:"ref_id"`
 
+	// The attachment was generated from the parent one, like the cover art of an audio
+	Parent   *Attachment `json:"parent"`
+	ParentID *uint       `json:"parent_id" gorm:"index"`
+
 	Pool   *AttachmentPool `json:"pool"`
 	PoolID *uint           `json:"pool_id"`
 
@@ -77,6 +124,40 @@ type Attachment struct {
 	IsMature   bool              `json:"is_mature" gorm:"-"`
 }
 
+// CanTransitTo reports the attachment is allowed to move from the current status to the target
+func (v *Attachment) CanTransitTo(status string) bool {
+	if v.Status == status {
+		return true
+	}
+	for _, target := range AttachmentStatusTransitions[v.Status] {
+		if target == status {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPerceptualHash sets the perceptual hash with its bands, nil clears them
+func (v *Attachment) SetPerceptualHash(hash *int64) {
+	v.PerceptualHash = hash
+	bands := []**int{&v.PerceptualHashBand0, &v.PerceptualHashBand1, &v.PerceptualHashBand2, &v.PerceptualHashBand3}
+	for idx, band := range bands {
+		if hash == nil {
+			*band = nil
+		} else {
+			val := int(uint64(*hash) >> (48 - 16*idx) & 0xffff)
+			*band = &val
+		}
+	}
+}
+
+func (v *Attachment) BeforeCreate(tx *gorm.DB) error {
+	if len(v.Status) == 0 {
+		v.Status = AttachmentStatusPending
+	}
+	return nil
+}
+
 func (v *Attachment) AfterUpdate(tx *gorm.DB) error {
 	cacheManager := cache.New[any](localCache.S)
 	marshal := marshaler.New(cacheManager)
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"git.solsynth.dev/hypernet/nexus/pkg/nex/cruda"
+	"gorm.io/datatypes"
+)
+
+const (
+	JobTypeAnalyze     = "analyze"
+	JobTypeTransfer    = "transfer"
+	JobTypeTranscode   = "transcode"
+	JobTypePlaceholder = "placeholder"
+	JobTypeWebhook     = "webhook" // Not bound to an attachment, the delivery id is in the payload
+)
+
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusDead      = "dead" // Failed after all the attempts, need to be retried manually
+)
+
+const (
+	JobPriorityBackground = 0
+	JobPriorityHigh       = 10 // Requested by the uploader via analyzeNow
+)
+
+type Job struct {
+	cruda.BaseModel
+
+	Type     string            `json:"type" gorm:"index"`
+	Status   string            `json:"status" gorm:"index"`
+	Priority int               `json:"priority"`
+	Payload  datatypes.JSONMap `json:"payload"`
+
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"max_attempts"`
+	LastError   string `json:"last_error"`
+
+	// The job won't be picked up before this time, used for the retry backoff
+	RunAt time.Time `json:"run_at" gorm:"index"`
+	// The worker holding the job, the lease expired jobs will be picked up by other workers
+	LockedBy    *string    `json:"locked_by"`
+	LockedUntil *time.Time `json:"locked_until"`
+	FinishedAt  *time.Time `json:"finished_at"`
+
+	AttachmentID *uint `json:"attachment_id" gorm:"index"`
+}
@@ -5,6 +5,14 @@ import (
 	"gorm.io/datatypes"
 )
 
+const (
+	MetadataPolicyStripLocation = "strip_location" // Remove the GPS and the place names, the default one
+	MetadataPolicyStripAll      = "strip_all"      // Remove everything embedded except the orientation and the color profile
+	MetadataPolicyKeepAll       = "keep_all"       // Keep and expose everything embedded
+)
+
+var MetadataPolicies = []string{MetadataPolicyStripLocation, MetadataPolicyStripAll, MetadataPolicyKeepAll}
+
 type AttachmentPool struct {
 	cruda.BaseModel
 
@@ -24,4 +32,36 @@ type AttachmentPoolConfig struct {
 	AllowCrossPoolIngress bool   `json:"allow_cross_pool_ingress"`
 	AllowCrossPoolEgress  bool   `json:"allow_cross_pool_egress"`
 	PublicIndexable       bool   `json:"public_indexable"`
+	AccountQuotaSize      *int64 `json:"account_quota_size"`  // Total bytes one account can store in this pool
+	AccountQuotaCount     *int64 `json:"account_quota_count"` // Total files one account can store in this pool
+	MaxImagePixels        *int64 `json:"max_image_pixels"`    // The larger images won't be decoded, to protect from the decompression bombs
+	// Content type policies, the types supports wildcard like image/*, the extensions should start with a dot
+	AllowedTypes      []string `json:"allowed_types"`
+	DeniedTypes       []string `json:"denied_types"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+	DeniedExtensions  []string `json:"denied_extensions"`
+	// Analyzers can be picked by their names, only the enabled ones will run if provided
+	EnabledAnalyzers  []string `json:"enabled_analyzers"`
+	DisabledAnalyzers []string `json:"disabled_analyzers"`
+	// Transcode the videos into an HLS ladder, the heights fall back to the hls.renditions setting if not provided
+	EnableHLS     bool  `json:"enable_hls"`
+	HLSRenditions []int `json:"hls_renditions"`
+	// Generate the images in the modern formats like WebP and AVIF, they will be served to the clients accept them
+	EnableCompression bool `json:"enable_compression"`
+	// Privacy policy of the embedded metadata, covers the EXIF, XMP, IPTC and the video container tags
+	// The original file will be rewritten unless the hide only set, which only hides the stripped fields from the metadata
+	MetadataPolicy       string `json:"metadata_policy"`
+	MetadataHideOnly     bool   `json:"metadata_hide_only"`
+	StorePrivateMetadata bool   `json:"store_private_metadata"` // Keep the stripped fields, only visible to the owner of the attachment
+	// Rotate the pixels of the JPEG and PNG images by their EXIF orientation, otherwise only the reported size follows it
+	NormalizeOrientation bool `json:"normalize_orientation"`
+	// Transcode the large GIFs into the videos, the MP4 one will be used as the compressed version
+	TranscodeAnimations bool `json:"transcode_animations"`
+}
+
+func (v AttachmentPoolConfig) GetMetadataPolicy() string {
+	if len(v.MetadataPolicy) == 0 {
+		return MetadataPolicyStripLocation
+	}
+	return v.MetadataPolicy
 }
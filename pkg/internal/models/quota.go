@@ -0,0 +1,17 @@
+package models
+
+import "git.solsynth.dev/hypernet/nexus/pkg/nex/cruda"
+
+// AttachmentQuota overrides the default storage quota of an account.
+// When the pool is set, the quota only applies to the attachments inside that pool.
+type AttachmentQuota struct {
+	cruda.BaseModel
+
+	MaxSize  *int64 `json:"max_size"`  // Total bytes, nil means fallback to the default
+	MaxCount *int64 `json:"max_count"` // Total files, nil means fallback to the default
+
+	Pool   *AttachmentPool `json:"pool"`
+	PoolID *uint           `json:"pool_id"`
+
+	AccountID uint `json:"account_id"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"git.solsynth.dev/hypernet/nexus/pkg/nex/cruda"
+	"gorm.io/datatypes"
+)
+
+// AttachmentWebhook will receive the lifecycle events of attachments.
+// The webhook without pool receives the events of the attachments owned by the account,
+// and the webhook with pool receives the events of all the attachments inside the pool.
+type AttachmentWebhook struct {
+	cruda.BaseModel
+
+	Url      string                      `json:"url"`
+	Secret   string                      `json:"-"`      // Use to sign the deliveries with HMAC-SHA256, only shown once when created
+	Events   datatypes.JSONSlice[string] `json:"events"` // Empty means subscribe all the events
+	IsActive bool                        `json:"is_active"`
+
+	Pool   *AttachmentPool `json:"pool"`
+	PoolID *uint           `json:"pool_id"`
+
+	AccountID uint `json:"account_id"`
+}
+
+// AttachmentWebhookDelivery is the log of one webhook delivery, including all the retries
+type AttachmentWebhookDelivery struct {
+	cruda.BaseModel
+
+	Event       string            `json:"event"`
+	Payload     datatypes.JSONMap `json:"payload"`
+	StatusCode  int               `json:"status_code"`
+	Error       string            `json:"error"`
+	Attempts    int               `json:"attempts"`
+	DeliveredAt *time.Time        `json:"delivered_at"`
+
+	Webhook   AttachmentWebhook `json:"webhook"`
+	WebhookID uint              `json:"webhook_id"`
+}
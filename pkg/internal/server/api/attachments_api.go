@@ -1,7 +1,9 @@
 package api
 
 import (
+	"bufio"
 	"fmt"
+	"sort"
 	"strings"
 
 	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
@@ -11,12 +13,31 @@ import (
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/services"
 	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
 )
 
 func openAttachment(c *fiber.Ctx) error {
 	id := c.Params("id")
 	region := c.Query("region")
 
+	// Serve the compressed rendition in the modern format if the client accepts it
+	c.Vary(fiber.HeaderAccept)
+
+	var transform services.AttachmentTransform
+	if err := c.QueryParser(&transform); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	// Transforming drops the frames, the animated images are served as they are
+	if !transform.IsEmpty() && !services.IsAnimatedAttachment(id) {
+		return openTransformedAttachment(c, id, transform)
+	}
+
+	if !c.QueryBool("original", false) {
+		id = services.NegotiateAttachmentRendition(id, c.Get(fiber.HeaderAccept))
+	}
+
 	var err error
 	var url, mimetype string
 	if len(region) > 0 {
@@ -39,6 +60,26 @@ func openAttachment(c *fiber.Ctx) error {
 	return c.Redirect(url, fiber.StatusFound)
 }
 
+func openTransformedAttachment(c *fiber.Ctx, id string, transform services.AttachmentTransform) error {
+	attachment, err := services.GetAttachmentByRID(id)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	transform, err = transform.Normalize(c.Get(fiber.HeaderAccept), attachment.MimeType)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	fp, err := services.TransformAttachment(id, transform)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	c.Set(fiber.HeaderContentType, transform.MimeType())
+	return c.SendFile(fp)
+}
+
 func getAttachmentMeta(c *fiber.Ctx) error {
 	id := c.Params("id")
 
@@ -138,3 +179,175 @@ func deleteAttachment(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusOK)
 	}
 }
+
+func getAttachmentScanResult(c *fiber.Ctx) error {
+	id := c.Params("id")
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	// Query the database directly, the verdict won't be kept in the cache
+	var attachment models.Attachment
+	if err := database.C.Where("rid = ?", id).First(&attachment).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if attachment.AccountID != user.ID && !user.HasPermNode("ManageAttachments", true) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to view the scan result of this attachment")
+	}
+
+	return c.JSON(fiber.Map{
+		"is_scanned":     attachment.ScannedAt != nil,
+		"is_quarantined": attachment.IsQuarantined,
+		"verdict":        attachment.ScanVerdict,
+		"scanned_at":     attachment.ScannedAt,
+	})
+}
+
+func getAttachmentPrivateMeta(c *fiber.Ctx) error {
+	id := c.Params("id")
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	// Query the database directly, the private metadata won't be kept in the cache
+	var attachment models.Attachment
+	if err := database.C.Where("rid = ?", id).First(&attachment).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if attachment.AccountID != user.ID {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to view the private metadata of this attachment")
+	}
+
+	return c.JSON(attachment.PrivateMetadata)
+}
+
+func listSimilarAttachments(c *fiber.Ctx) error {
+	id := c.Params("id")
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	take := c.QueryInt("take", 0)
+	offset := c.QueryInt("offset", 0)
+	if take > 100 {
+		take = 100
+	}
+	distance := c.QueryInt("distance", 10)
+	if distance < 0 || distance > services.MaxPerceptualDistance {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("distance must be between 0 and %d", services.MaxPerceptualDistance))
+	}
+
+	var attachment models.Attachment
+	if err := database.C.Where("rid = ?", id).Preload("Pool").First(&attachment).Error; err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	// The matches tell what the source looks like, only search by the attachments the user can see
+	isAdmin := user.HasPermNode("ManageAttachments", true)
+	isVisible := attachment.AccountID == user.ID ||
+		(attachment.IsIndexable && (attachment.Pool == nil || attachment.Pool.Config.Data().PublicIndexable))
+	if attachment.IsQuarantined {
+		return fiber.NewError(fiber.StatusNotFound, "attachment was quarantined")
+	} else if !isAdmin && !isVisible {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to search by this attachment")
+	}
+	tx := database.C
+	switch c.Query("scope", "user") {
+	case "user":
+		tx = tx.Where("account_id = ?", user.ID)
+	case "pool":
+		if attachment.Pool == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "attachment isn't in any pool")
+		}
+		isOwner := attachment.Pool.AccountID != nil && *attachment.Pool.AccountID == user.ID
+		if !isAdmin && !isOwner && !attachment.Pool.Config.Data().PublicIndexable {
+			return fiber.NewError(fiber.StatusForbidden, "you are not permitted to search in this pool")
+		}
+		tx = tx.Where("pool_id = ?", attachment.Pool.ID)
+	case "global":
+		if !isAdmin {
+			return fiber.NewError(fiber.StatusForbidden, "you are not permitted to search globally")
+		}
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "scope must be user, pool or global")
+	}
+
+	items, count, err := services.ListSimilarAttachments(tx, attachment, distance, take, offset)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(fiber.Map{
+		"count": count,
+		"data":  items,
+	})
+}
+
+func downloadAttachmentArchive(c *fiber.Ctx) error {
+	user, _ := c.Locals("nex_user").(*sec.UserInfo)
+
+	maxEntries := viper.GetInt("archives.max_entries")
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+
+	tx := database.C.Where("cleaned_at IS NULL AND is_quarantined = ?", false).
+		Where("COALESCE((metadata->'privacy'->>'failed')::boolean, false) = ?", false)
+
+	var idxList []string
+	if len(c.Query("id")) > 0 {
+		idxList = strings.Split(c.Query("id"), ",")
+		tx = tx.Where("rid IN ?", idxList).Preload("Pool")
+	} else if len(c.Query("pool")) > 0 {
+		pool, err := services.GetAttachmentPoolByAlias(c.Query("pool"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("unable to get attachment pool info: %v", err))
+		}
+		tx = tx.Where("pool_id = ?", pool.ID)
+		// Only the public indexable attachments or the attachments owned by the user can be downloaded as a whole pool
+		if pool.Config.Data().PublicIndexable && user != nil {
+			tx = tx.Where("is_indexable = ? OR account_id = ?", true, user.ID)
+		} else if pool.Config.Data().PublicIndexable {
+			tx = tx.Where("is_indexable = ?", true)
+		} else if user != nil {
+			tx = tx.Where("account_id = ?", user.ID)
+		} else {
+			return fiber.NewError(fiber.StatusUnauthorized, "this attachment pool isn't public")
+		}
+		tx = tx.Order("created_at DESC")
+	} else {
+		return fiber.NewError(fiber.StatusBadRequest, "you must provide attachment ids or pool to download")
+	}
+
+	var attachments []models.Attachment
+	if err := tx.Limit(maxEntries + 1).Find(&attachments).Error; err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	} else if len(attachments) > maxEntries {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("too many attachments to archive, the limit is %d", maxEntries))
+	} else if len(attachments) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "no attachments available to archive")
+	}
+
+	if len(idxList) > 0 {
+		// Apply the same rule as downloading the whole pool to each of them, the others will be skipped
+		attachments = lo.Filter(attachments, func(item models.Attachment, _ int) bool {
+			if user != nil && item.AccountID == user.ID {
+				return true
+			}
+			return item.IsIndexable && (item.Pool == nil || item.Pool.Config.Data().PublicIndexable)
+		})
+		if len(attachments) == 0 {
+			return fiber.NewError(fiber.StatusForbidden, "you are not permitted to download these attachments")
+		}
+
+		// Keep the order same as requested
+		sort.SliceStable(attachments, func(i, j int) bool {
+			return lo.IndexOf(idxList, attachments[i].Rid) < lo.IndexOf(idxList, attachments[j].Rid)
+		})
+	}
+
+	withManifest := c.QueryBool("manifest", false)
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="attachments.zip"`)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := services.WriteAttachmentsArchive(w, attachments, withManifest); err != nil {
+			log.Warn().Err(err).Int("count", len(attachments)).Msg("Unable to stream attachments archive...")
+		}
+		_ = w.Flush()
+	})
+
+	return nil
+}
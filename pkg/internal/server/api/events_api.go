@@ -0,0 +1,62 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/services"
+	"github.com/gofiber/fiber/v2"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/samber/lo"
+)
+
+// listenAttachmentEvents pushes the lifecycle events of the user's attachments as server-sent events
+// Use the rid query to only receive the events of specific attachments
+func listenAttachmentEvents(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	var filter []string
+	if len(c.Query("rid")) > 0 {
+		filter = strings.Split(c.Query("rid"), ",")
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ch, unsubscribe := services.SubscribeAttachmentEvents(user.ID)
+		defer unsubscribe()
+
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+
+		// Flush the headers first, and the flush will fail when the client disconnected
+		fmt.Fprint(w, ": connected\n\n")
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case event := <-ch:
+				if len(filter) > 0 && !lo.Contains(filter, event.Rid) {
+					continue
+				}
+				raw, _ := jsoniter.Marshal(event)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, raw)
+			case <-ticker.C:
+				fmt.Fprint(w, ": ping\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/services"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/cast"
+)
+
+const hlsPlaylistMimeType = "application/vnd.apple.mpegurl"
+
+func openAttachmentHlsMaster(c *fiber.Ctx) error {
+	attachment, err := services.GetAttachmentByRID(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if attachment.IsQuarantined {
+		return fiber.NewError(fiber.StatusNotFound, "attachment was quarantined")
+	}
+
+	playlists, err := services.GetAttachmentHlsPlaylists(attachment, true)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	} else if len(playlists) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "attachment has no available hls renditions")
+	}
+
+	c.Set(fiber.HeaderContentType, hlsPlaylistMimeType)
+	return c.SendString(services.BuildHlsMasterPlaylist(playlists))
+}
+
+func openAttachmentHlsPlaylist(c *fiber.Ctx) error {
+	height, err := strconv.Atoi(strings.TrimSuffix(c.Params("rendition"), "p.m3u8"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "rendition not found")
+	}
+
+	attachment, err := services.GetAttachmentByRID(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if attachment.IsQuarantined {
+		return fiber.NewError(fiber.StatusNotFound, "attachment was quarantined")
+	}
+
+	playlists, err := services.GetAttachmentHlsPlaylists(attachment, true)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	for _, item := range playlists {
+		if cast.ToInt(item.Metadata["height"]) != height {
+			continue
+		}
+		content, err := services.ReadHlsPlaylist(item)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		c.Set(fiber.HeaderContentType, hlsPlaylistMimeType)
+		return c.Send(content)
+	}
+
+	return fiber.NewError(fiber.StatusNotFound, "rendition not found")
+}
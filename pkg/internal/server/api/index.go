@@ -10,6 +10,12 @@ func MapAPIs(app *fiber.App, baseURL string) {
 	{
 		api.Get("/destinations", listDestination)
 
+		quota := api.Group("/quota").Name("Quota API")
+		{
+			quota.Get("/", sec.ValidatorMiddleware, getQuota)
+			quota.Put("/:accountId", sec.ValidatorMiddleware, updateQuota)
+		}
+
 		boost := api.Group("/boosts").Name("Boosts API")
 		{
 			boost.Get("/", listBoostByUser)
@@ -19,6 +25,24 @@ func MapAPIs(app *fiber.App, baseURL string) {
 			boost.Put("/:boostId", sec.ValidatorMiddleware, updateBoost)
 		}
 
+		webhooks := api.Group("/webhooks").Name("Webhooks API")
+		{
+			webhooks.Get("/", sec.ValidatorMiddleware, listWebhooks)
+			webhooks.Get("/:webhookId", sec.ValidatorMiddleware, getWebhook)
+			webhooks.Get("/:webhookId/deliveries", sec.ValidatorMiddleware, listWebhookDeliveries)
+			webhooks.Post("/", sec.ValidatorMiddleware, createWebhook)
+			webhooks.Put("/:webhookId", sec.ValidatorMiddleware, updateWebhook)
+			webhooks.Delete("/:webhookId", sec.ValidatorMiddleware, deleteWebhook)
+		}
+
+		jobs := api.Group("/jobs").Name("Jobs API")
+		{
+			jobs.Get("/", sec.ValidatorMiddleware, listJobs)
+			jobs.Get("/stats", sec.ValidatorMiddleware, getJobStats)
+			jobs.Get("/:jobId", sec.ValidatorMiddleware, getJob)
+			jobs.Post("/:jobId/retry", sec.ValidatorMiddleware, retryJob)
+		}
+
 		pools := api.Group("/pools").Name("Pools API")
 		{
 			pools.Get("/", listPool)
@@ -33,7 +57,14 @@ func MapAPIs(app *fiber.App, baseURL string) {
 			attachments.Get("/:attachmentId/boosts", listBoostByAttachment)
 
 			attachments.Get("/", listAttachment)
+			attachments.Get("/archive", downloadAttachmentArchive)
+			attachments.Get("/events", sec.ValidatorMiddleware, listenAttachmentEvents)
 			attachments.Get("/:id/meta", getAttachmentMeta)
+			attachments.Get("/:id/meta/private", sec.ValidatorMiddleware, getAttachmentPrivateMeta)
+			attachments.Get("/:id/scan", sec.ValidatorMiddleware, getAttachmentScanResult)
+			attachments.Get("/:id/similar", sec.ValidatorMiddleware, listSimilarAttachments)
+			attachments.Get("/:id/hls/master.m3u8", openAttachmentHlsMaster)
+			attachments.Get("/:id/hls/:rendition", openAttachmentHlsPlaylist)
 			attachments.Get("/:id", openAttachment)
 			attachments.Post("/", sec.ValidatorMiddleware, createAttachmentDirectly)
 			attachments.Put("/:id", sec.ValidatorMiddleware, updateAttachmentMeta)
@@ -8,6 +8,7 @@ import (
 	"git.solsynth.dev/hypernet/passport/pkg/authkit"
 	"github.com/spf13/viper"
 	"gorm.io/datatypes"
+	"gorm.io/gorm/clause"
 
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
@@ -33,9 +34,13 @@ func listAttachment(c *fiber.Ctx) error {
 	if len(c.Query("id")) > 0 {
 		var pendingQueryId []string
 		idx := strings.Split(c.Query("id"), ",")
+		// The dominant color isn't kept in the cache, filter them by the database instead
+		useCache := len(c.Query("color")) == 0
 		for p, raw := range idx {
 			idxList = append(idxList, raw)
-			if val, ok := services.GetAttachmentCache(raw); ok {
+			if !useCache {
+				pendingQueryId = append(pendingQueryId, raw)
+			} else if val, ok := services.GetAttachmentCache(raw); ok {
 				result[p] = val
 			} else {
 				pendingQueryId = append(pendingQueryId, raw)
@@ -76,6 +81,48 @@ func listAttachment(c *fiber.Ctx) error {
 		tx = tx.Where("ref_id IS NULL")
 	}
 
+	if query := c.Query("q"); len(query) > 0 {
+		prefix := viper.GetString("database.prefix")
+		tx = tx.Where(
+			fmt.Sprintf("(%sattachments.name ILIKE ? OR to_tsvector('simple', %sattachments.content_text) @@ plainto_tsquery('simple', ?))", prefix, prefix),
+			"%"+query+"%", query,
+		)
+	}
+
+	if status := c.Query("status"); len(status) > 0 {
+		prefix := viper.GetString("database.prefix")
+		tx = tx.Where(fmt.Sprintf("%sattachments.status IN ?", prefix), strings.Split(status, ","))
+	}
+
+	if color := c.Query("color"); len(color) > 0 {
+		target, err := services.ParseHexColor(color)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		maxDistance := c.QueryInt("color_distance", 64)
+		if maxDistance < 0 || maxDistance > 442 {
+			return fiber.NewError(fiber.StatusBadRequest, "color_distance must be between 0 and 442")
+		}
+
+		// The squared euclidean distance in the rgb space, the values are parsed integers so they can be put into the query
+		prefix := viper.GetString("database.prefix")
+		column := fmt.Sprintf("%sattachments.dominant_color", prefix)
+		distance := fmt.Sprintf(
+			"(power(((%s >> 16) & 255) - %d, 2) + power(((%s >> 8) & 255) - %d, 2) + power((%s & 255) - %d, 2))",
+			column, (target>>16)&255, column, (target>>8)&255, column, target&255,
+		)
+		tx = tx.Where(fmt.Sprintf("%s IS NOT NULL AND %s <= ?", column, distance), maxDistance*maxDistance)
+		if len(idxList) == 0 {
+			// The closest colors come first
+			tx = tx.Clauses(clause.OrderBy{
+				Columns: []clause.OrderByColumn{
+					{Column: clause.Column{Name: distance, Raw: true}, Reorder: true},
+					{Column: clause.Column{Table: prefix + "attachments", Name: "created_at"}, Desc: true},
+				},
+			})
+		}
+	}
+
 	var count int64
 	countTx := tx
 	if err := countTx.Model(&models.Attachment{}).Count(&count).Error; err != nil {
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/services"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func listJobs(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+	if !user.HasPermNode("ManageJobs", true) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to inspect the job queue")
+	}
+
+	take := c.QueryInt("take", 0)
+	offset := c.QueryInt("offset", 0)
+
+	if take > 100 {
+		take = 100
+	}
+
+	tx := database.C.Model(&models.Job{})
+	if status := c.Query("status"); len(status) > 0 {
+		tx = tx.Where("status = ?", status)
+	}
+	if kind := c.Query("type"); len(kind) > 0 {
+		tx = tx.Where("type = ?", kind)
+	}
+	if id := c.QueryInt("attachment", 0); id > 0 {
+		tx = tx.Where("attachment_id = ?", id)
+	}
+
+	count, err := services.CountJobs(tx.Session(&gorm.Session{}))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	jobs, err := services.ListJobs(tx, take, offset)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(fiber.Map{
+		"count": count,
+		"data":  jobs,
+	})
+}
+
+func getJobStats(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+	if !user.HasPermNode("ManageJobs", true) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to inspect the job queue")
+	}
+
+	stats, err := services.CountJobsByStatus()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(stats)
+}
+
+func getJob(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+	if !user.HasPermNode("ManageJobs", true) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to inspect the job queue")
+	}
+
+	id, _ := c.ParamsInt("jobId", 0)
+	job, err := services.GetJob(uint(id))
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(job)
+}
+
+func retryJob(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+	if !user.HasPermNode("ManageJobs", true) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to manage the job queue")
+	}
+
+	id, _ := c.ParamsInt("jobId", 0)
+	job, err := services.GetJob(uint(id))
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	if job, err := services.RetryJob(job); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	} else {
+		return c.JSON(job)
+	}
+}
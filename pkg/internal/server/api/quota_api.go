@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+
+	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/server/exts"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/services"
+	"github.com/gofiber/fiber/v2"
+)
+
+func getQuota(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	var pool *models.AttachmentPool
+	if alias := c.Query("pool"); len(alias) > 0 {
+		val, err := services.GetAttachmentPoolByAlias(alias)
+		if err != nil {
+			return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("unable to get attachment pool info: %v", err))
+		}
+		pool = &val
+	}
+
+	info, err := services.GetAttachmentQuotaInfo(user.ID, pool)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(info)
+}
+
+func updateQuota(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+	if !user.HasPermNode("ManageQuotas", true) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not permitted to manage quotas")
+	}
+
+	var data struct {
+		Pool     *string `json:"pool"`
+		MaxSize  *int64  `json:"max_size"`
+		MaxCount *int64  `json:"max_count"`
+	}
+
+	if err := exts.BindAndValidate(c, &data); err != nil {
+		return err
+	}
+
+	accountId, err := c.ParamsInt("accountId", 0)
+	if err != nil || accountId <= 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid account id")
+	}
+
+	var pool *models.AttachmentPool
+	if data.Pool != nil {
+		val, err := services.GetAttachmentPoolByAlias(*data.Pool)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unable to get attachment pool info: %v", err))
+		}
+		pool = &val
+	}
+
+	if quota, err := services.SetAttachmentQuota(uint(accountId), pool, data.MaxSize, data.MaxCount); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	} else {
+		return c.JSON(quota)
+	}
+}
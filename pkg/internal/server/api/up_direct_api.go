@@ -2,12 +2,16 @@ package api
 
 import (
 	"fmt"
+	"mime/multipart"
+	"os"
+	"path/filepath"
 
 	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/services"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/spf13/viper"
 )
@@ -41,6 +45,14 @@ func createAttachmentDirectly(c *fiber.Ctx) error {
 	usermeta := make(map[string]any)
 	_ = jsoniter.UnmarshalFromString(c.FormValue("metadata"), &usermeta)
 
+	if c.FormValue("expand") == "true" {
+		return createAttachmentsFromArchive(c, user, pool, file, usermeta)
+	}
+
+	if err := services.CheckAttachmentQuota(user.ID, pool, file.Size); err != nil {
+		return fiber.NewError(fiber.StatusForbidden, err.Error())
+	}
+
 	tx := database.C.Begin()
 
 	metadata, err := services.NewAttachmentMetadata(tx, user, file, models.Attachment{
@@ -65,12 +77,51 @@ func createAttachmentDirectly(c *fiber.Ctx) error {
 	tx.Commit()
 
 	metadata.Pool = &pool
+	services.PublishAttachmentEvent(services.NewAttachmentEvent(services.AttachmentEventCreated, metadata))
 
 	if c.QueryBool("analyzeNow", false) {
-		services.AnalyzeAttachment(metadata)
+		services.PublishAnalyzeTask(metadata, models.JobPriorityHigh)
 	} else {
 		services.PublishAnalyzeTask(metadata)
 	}
 
 	return c.JSON(metadata)
 }
+
+func createAttachmentsFromArchive(c *fiber.Ctx, user *sec.UserInfo, pool models.AttachmentPool, file *multipart.FileHeader, usermeta map[string]any) error {
+	format := services.GetArchiveFormat(file.Filename)
+	if len(format) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "only .zip, .tar and .tar.gz archives can be expanded")
+	}
+
+	destMap := viper.GetStringMapString("destinations.0")
+	archivePath := filepath.Join(destMap["path"], fmt.Sprintf("%s.archive", uuid.NewString()))
+	if err := c.SaveFile(file, archivePath); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	defer os.Remove(archivePath)
+
+	tx := database.C.Begin()
+
+	attachments, err := services.ExpandArchiveToAttachments(tx, user, pool, archivePath, format, models.Attachment{
+		Alternative: c.FormValue("alt"),
+		Usermeta:    usermeta,
+		IsAnalyzed:  false,
+	})
+	if err != nil {
+		tx.Rollback()
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	tx.Commit()
+
+	for _, attachment := range attachments {
+		services.PublishAttachmentEvent(services.NewAttachmentEvent(services.AttachmentEventCreated, attachment))
+		services.PublishAnalyzeTask(attachment)
+	}
+
+	return c.JSON(fiber.Map{
+		"count": len(attachments),
+		"data":  attachments,
+	})
+}
@@ -47,6 +47,13 @@ func createAttachmentFragment(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("attachment pool %s doesn't allow file larger than %d", pool.Alias, *pool.Config.Data().MaxFileSize))
 	}
 
+	if err := services.CheckAttachmentQuota(user.ID, pool, data.Size); err != nil {
+		return fiber.NewError(fiber.StatusForbidden, err.Error())
+	}
+	if err := services.CheckAttachmentPoolPolicy(&pool, data.FileName, data.MimeType); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
 	metadata, err := services.NewAttachmentFragment(database.C, user, models.AttachmentFragment{
 		Name:        data.FileName,
 		Size:        data.Size,
@@ -100,6 +107,14 @@ func uploadFragmentChunk(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 
+	services.PublishAttachmentEvent(services.AttachmentEvent{
+		Type:      services.AttachmentEventChunkReceived,
+		Rid:       meta.Rid,
+		AccountID: meta.AccountID,
+		PoolID:    meta.PoolID,
+		Data:      map[string]any{"chunk": cid, "size": len(fileData)},
+	})
+
 	chunkArrange := make([]string, len(meta.FileChunks))
 	isAllUploaded := true
 	for cid, idx := range meta.FileChunks {
@@ -125,13 +140,22 @@ func uploadFragmentChunk(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
 
+	// Verify the content of the merged file
+	if err := services.VerifyAttachmentContent(&attachment); err != nil {
+		go fs.DeleteFile(attachment)
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
 	// Post-upload tasks
 	if err := database.C.Save(&attachment).Error; err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
 
+	services.PublishAttachmentEvent(services.NewAttachmentEvent(services.AttachmentEventMerged, attachment))
+	services.PublishAttachmentEvent(services.NewAttachmentEvent(services.AttachmentEventCreated, attachment))
+
 	if c.QueryBool("analyzeNow", false) {
-		services.AnalyzeAttachment(attachment)
+		services.PublishAnalyzeTask(attachment, models.JobPriorityHigh)
 	} else {
 		services.PublishAnalyzeTask(attachment)
 	}
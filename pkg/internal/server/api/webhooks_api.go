@@ -0,0 +1,178 @@
+package api
+
+import (
+	"fmt"
+
+	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/server/exts"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/services"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/datatypes"
+)
+
+func listWebhooks(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	webhooks, err := services.ListWebhookByUser(user.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(webhooks)
+}
+
+func getWebhook(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	id, _ := c.ParamsInt("webhookId", 0)
+	webhook, err := services.GetWebhookWithUser(uint(id), user.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(webhook)
+}
+
+func listWebhookDeliveries(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+	take := c.QueryInt("take", 0)
+	offset := c.QueryInt("offset", 0)
+
+	if take > 100 {
+		take = 100
+	}
+
+	id, _ := c.ParamsInt("webhookId", 0)
+	webhook, err := services.GetWebhookWithUser(uint(id), user.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	count, err := services.CountWebhookDeliveries(webhook.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	deliveries, err := services.ListWebhookDeliveries(webhook.ID, take, offset)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(fiber.Map{
+		"count": count,
+		"data":  deliveries,
+	})
+}
+
+type webhookRequest struct {
+	Url      string   `json:"url" validate:"required,url"`
+	Secret   string   `json:"secret"`
+	Events   []string `json:"events" validate:"dive,oneof=created analyzed ready deleted boost_activated lifecycle_cleaned"`
+	Pool     *string  `json:"pool"`
+	IsActive bool     `json:"is_active"`
+}
+
+func getWebhookPool(user *sec.UserInfo, alias *string) (*models.AttachmentPool, error) {
+	if alias == nil {
+		return nil, nil
+	}
+
+	pool, err := services.GetAttachmentPoolByAlias(*alias)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get attachment pool info: %v", err)
+	} else if pool.AccountID == nil || *pool.AccountID != user.ID {
+		return nil, fmt.Errorf("only the owner of attachment pool %s can receive its events", pool.Alias)
+	}
+
+	return &pool, nil
+}
+
+func createWebhook(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	var data webhookRequest
+	if err := exts.BindAndValidate(c, &data); err != nil {
+		return err
+	}
+
+	pool, err := getWebhookPool(user, data.Pool)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	webhook := models.AttachmentWebhook{
+		Url:       data.Url,
+		Secret:    data.Secret,
+		Events:    datatypes.NewJSONSlice(data.Events),
+		IsActive:  data.IsActive,
+		AccountID: user.ID,
+	}
+	if pool != nil {
+		webhook.PoolID = &pool.ID
+	}
+
+	if webhook, err := services.NewWebhook(webhook); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	} else {
+		// The secret is only returned here, the receiver should save it now
+		return c.JSON(struct {
+			models.AttachmentWebhook
+			Secret string `json:"secret"`
+		}{webhook, webhook.Secret})
+	}
+}
+
+func updateWebhook(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	var data webhookRequest
+	if err := exts.BindAndValidate(c, &data); err != nil {
+		return err
+	}
+
+	id, _ := c.ParamsInt("webhookId", 0)
+	webhook, err := services.GetWebhookWithUser(uint(id), user.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	pool, err := getWebhookPool(user, data.Pool)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	webhook.Url = data.Url
+	webhook.Events = datatypes.NewJSONSlice(data.Events)
+	webhook.IsActive = data.IsActive
+	webhook.Pool = pool
+	webhook.PoolID = nil
+	if pool != nil {
+		webhook.PoolID = &pool.ID
+	}
+	if len(data.Secret) > 0 {
+		webhook.Secret = data.Secret
+	}
+
+	if webhook, err := services.UpdateWebhook(webhook); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	} else {
+		return c.JSON(webhook)
+	}
+}
+
+func deleteWebhook(c *fiber.Ctx) error {
+	user := c.Locals("nex_user").(*sec.UserInfo)
+
+	id, _ := c.ParamsInt("webhookId", 0)
+	webhook, err := services.GetWebhookWithUser(uint(id), user.ID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+
+	if webhook, err := services.DeleteWebhook(webhook); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	} else {
+		return c.JSON(webhook)
+	}
+}
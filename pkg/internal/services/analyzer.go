@@ -1,109 +1,36 @@
 package services
 
 import (
-	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"image"
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/barasher/go-exiftool"
 	"github.com/samber/lo"
+	"github.com/spf13/cast"
 
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/fs"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
-	jsoniter "github.com/json-iterator/go"
-	"github.com/k0kubun/go-ansi"
 	"github.com/rs/zerolog/log"
-	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/viper"
-	"gopkg.in/vansante/go-ffprobe.v2"
-
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
 )
 
-var fileAnalyzeQueue = make(chan models.Attachment, 256)
-
-func PublishAnalyzeTask(file models.Attachment) {
-	fileAnalyzeQueue <- file
-}
-
-func StartConsumeAnalyzeTask() {
-	for {
-		task := <-fileAnalyzeQueue
-		start := time.Now()
-		if err := AnalyzeAttachment(task); err != nil {
-			log.Error().Err(err).Any("task", task).Msg("A file analyze task failed...")
-		} else {
-			log.Info().Dur("elapsed", time.Since(start)).Uint("id", task.ID).Msg("A file analyze task was completed.")
-		}
-	}
-}
-
-func ScanUnanalyzedFileFromDatabase() {
-	workers := viper.GetInt("workers.files_analyze")
-
-	if workers < 2 {
-		log.Warn().Int("val", workers).Int("min", 2).Msg("The file analyzer does not have enough computing power, and the scan of unanalyzed files will not start...")
-	}
-
-	var attachments []models.Attachment
-	if err := database.C.
-		Where("is_uploaded = ?", true).
-		Where("destination = ? OR is_analyzed = ?", models.AttachmentDstTemporary, false).
-		Find(&attachments).Error; err != nil {
-		log.Error().Err(err).Msg("Scan unanalyzed files from database failed...")
-		return
-	}
-
-	if len(attachments) == 0 {
-		return
-	}
-
-	go func() {
-		var deletionIdSet []uint
-		bar := progressbar.NewOptions(len(attachments),
-			progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
-			progressbar.OptionEnableColorCodes(true),
-			progressbar.OptionShowBytes(true),
-			progressbar.OptionSetWidth(15),
-			progressbar.OptionSetDescription("Analyzing the unanalyzed files..."),
-			progressbar.OptionSetTheme(progressbar.Theme{
-				Saucer:        "[green]=[reset]",
-				SaucerHead:    "[green]>[reset]",
-				SaucerPadding: " ",
-				BarStart:      "[",
-				BarEnd:        "]",
-			}))
-		for _, task := range attachments {
-			if err := AnalyzeAttachment(task); err != nil {
-				log.Error().Err(err).Any("task", task).Msg("A background file analyze task failed...")
-				deletionIdSet = append(deletionIdSet, task.ID)
-			}
-			bar.Add(1)
-		}
-		log.Info().Int("count", len(attachments)).Int("fails", len(deletionIdSet)).Msg("All unanalyzed files has been analyzed!")
-
-		if len(deletionIdSet) > 0 {
-			database.C.Delete(&models.Attachment{}, deletionIdSet)
-		}
-	}()
-}
-
-func AnalyzeAttachment(file models.Attachment) error {
+// AnalyzeAttachment analyzes the file in the temporary storage and enqueues the transfer to the permanent storage
+// The failed event will be published by the job queue after all the attempts failed
+func AnalyzeAttachment(file models.Attachment, priority ...int) error {
 	if file.Destination != models.AttachmentDstTemporary {
 		return fmt.Errorf("attachment isn't in temporary storage, unable to analyze")
+	} else if err := SetAttachmentStatus(database.C, &file, models.AttachmentStatusAnalyzing); err != nil {
+		return err
 	}
 
+	PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventAnalyzing, file))
+
 	var start time.Time
 
 	if len(file.HashCode) == 0 {
@@ -114,147 +41,225 @@ func AnalyzeAttachment(file models.Attachment) error {
 		}
 	}
 
+	// Scan the file before doing anything with it
+	if file.ScannedAt == nil {
+		destMap := viper.GetStringMapString("destinations.0")
+		verdict, err := ScanAttachmentFile(filepath.Join(destMap["path"], file.Uuid))
+		if err != nil {
+			return fmt.Errorf("unable to scan file: %v", err)
+		} else if verdict != nil {
+			file.ScannedAt = lo.ToPtr(time.Now())
+			if verdict.Infected {
+				log.Warn().Uint("id", file.ID).Str("signature", verdict.Signature).Msg("An infected file was found, quarantining...")
+				if err := QuarantineAttachment(file, verdict.Signature); err != nil {
+					return err
+				}
+				PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventFailed, file, map[string]any{"reason": "quarantined"}))
+				return nil
+			}
+		}
+	}
+
 	// Do analyze jobs
+	var derived []AttachmentDerivedFile
 	if !file.IsAnalyzed || len(file.HashCode) == 0 {
-		destMap := viper.GetStringMap("destinations.0")
-
-		var dest models.LocalDestination
-		rawDest, _ := jsoniter.Marshal(destMap)
-		_ = jsoniter.Unmarshal(rawDest, &dest)
+		destMap := viper.GetStringMapString("destinations.0")
+		dst := filepath.Join(destMap["path"], file.Uuid)
 
 		start = time.Now()
 
-		dst := filepath.Join(dest.Path, file.Uuid)
-		if _, err := os.Stat(dst); os.IsNotExist(err) {
-			return fmt.Errorf("attachment doesn't exists in temporary storage: %v", err)
+		if file.Metadata == nil {
+			file.Metadata = make(map[string]any)
 		}
 
-		exifWhitelist := []string{
-			"Model", "ShutterSpeed", "ISO", "Megapixels", "Aperture",
-			"ColorSpace", "ColorTemperature", "ColorTone", "Contrast",
-			"ExposureTime", "FNumber", "FocalLength", "Flash", "HDREffect",
-			"LensModel",
+		// The rewrites below change the content of the file, its size and hash must follow
+		var rewritten bool
+
+		// Apply the privacy policy of the pool before the analyzers, the location data is stripped by default
+		// The HLS renditions are skipped, rewriting them will break the byte ranges in the playlists, and they have no metadata anyway
+		if kind := strings.SplitN(file.MimeType, "/", 2)[0]; (kind == "image" || kind == "video") && file.Metadata["derived"] != hlsDerivedRendition {
+			if privacy, err := ApplyAttachmentPrivacyPolicy(file, dst); err != nil {
+				// Fail closed, the file won't be served until the policy applied, it will be failed after all the attempts
+				file.Metadata["privacy"] = map[string]any{
+					"policy": privacy.Policy,
+					"failed": true,
+					"error":  err.Error(),
+				}
+				if err := database.C.Model(&file).Update("metadata", file.Metadata).Error; err != nil {
+					log.Warn().Err(err).Uint("id", file.ID).Msg("Unable to record the privacy policy failure of file...")
+				}
+				return fmt.Errorf("unable to apply the metadata privacy policy: %v", err)
+			} else {
+				rewritten = rewritten || privacy.Rewritten
+				file.Metadata["privacy"] = map[string]any{
+					"policy":    privacy.Policy,
+					"rewritten": privacy.Rewritten,
+					"stripped":  len(privacy.Stripped),
+				}
+				if len(privacy.Stripped) > 0 && file.Pool != nil && file.Pool.Config.Data().StorePrivateMetadata {
+					file.PrivateMetadata = privacy.Stripped
+				}
+			}
 		}
 
-		switch strings.SplitN(file.MimeType, "/", 2)[0] {
-		case "image":
-			// Dealing with image
-			reader, err := os.Open(dst)
-			if err != nil {
-				return fmt.Errorf("unable to open file: %v", err)
-			}
-			defer reader.Close()
-			im, _, err := image.Decode(reader)
-			if err != nil {
-				return fmt.Errorf("unable to decode file as an image: %v", err)
-			}
-			width := im.Bounds().Dx()
-			height := im.Bounds().Dy()
-			ratio := float64(width) / float64(height)
-			file.Metadata = map[string]any{
-				"width":  width,
-				"height": height,
-				"ratio":  ratio,
-				"exif":   map[string]any{},
+		if strings.HasPrefix(file.MimeType, "image/") && file.Pool != nil && file.Pool.Config.Data().NormalizeOrientation {
+			if ok, err := NormalizeAttachmentOrientation(file, dst); err != nil {
+				log.Warn().Err(err).Uint("id", file.ID).Msg("Unable to normalize the orientation of file...")
+			} else if ok {
+				rewritten = true
+				file.Metadata["orientation_normalized"] = true
 			}
+		}
 
-			// Removing location EXIF data
-			et, err := exiftool.NewExiftool()
-			if err == nil {
-				defer et.Close()
-				exif := et.ExtractMetadata(dst)
-				for _, data := range exif {
-					for k := range data.Fields {
-						if strings.HasPrefix(k, "GPS") {
-							data.Clear(k)
-						} else if lo.Contains(exifWhitelist, k) {
-							file.Metadata["exif"].(map[string]any)[k] = data.Fields[k]
-						}
-					}
-				}
-				et.WriteMetadata(exif)
+		if rewritten {
+			// Hash the rewritten file again, otherwise it will be linked to the unstripped one uploaded before
+			if stat, err := os.Stat(dst); err != nil {
+				return fmt.Errorf("unable to read file: %v", err)
+			} else {
+				file.Size = stat.Size()
 			}
-		case "video":
-			// Dealing with video
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			data, err := ffprobe.ProbeURL(ctx, dst)
-			if err != nil {
-				return fmt.Errorf("unable to analyze video information: %v", err)
+			if hash, err := HashAttachment(file); err != nil {
+				return err
+			} else {
+				file.HashCode = hash
 			}
+		}
 
-			stream := data.FirstVideoStream()
-			ratio := float64(stream.Width) / float64(stream.Height)
-			duration, _ := strconv.ParseFloat(stream.Duration, 64)
-			file.Metadata = map[string]any{
-				"width":       stream.Width,
-				"height":      stream.Height,
-				"ratio":       ratio,
-				"duration":    duration,
-				"bit_rate":    stream.BitRate,
-				"codec_name":  stream.CodecName,
-				"color_range": stream.ColorRange,
-				"color_space": stream.ColorSpace,
-				"exif":        map[string]any{},
-			}
+		result, err := RunAttachmentAnalyzers(file, dst)
+		if err != nil {
+			return err
+		}
+		defer result.Cleanup()
 
-			// Removing location EXIF data
-			et, err := exiftool.NewExiftool()
-			if err == nil {
-				defer et.Close()
-				exif := et.ExtractMetadata(dst)
-				for _, data := range exif {
-					for k := range data.Fields {
-						if strings.HasPrefix(k, "GPS") {
-							data.Clear(k)
-						} else if lo.Contains(exifWhitelist, k) {
-							file.Metadata["exif"].(map[string]any)[k] = data.Fields[k]
-						}
-					}
-				}
-				et.WriteMetadata(exif)
-			}
+		for k, v := range result.Metadata {
+			file.Metadata[k] = v
+		}
+		file.ContentText = result.Content
+		file.SetPerceptualHash(result.PerceptualHash)
+		if color, err := ParseHexColor(cast.ToString(result.Metadata["dominant_color"])); err == nil {
+			file.DominantColor = &color
+		}
+		if file.ParentID == nil {
+			// The derived files won't derive more files
+			derived = result.Derived
 		}
 	}
 
 	tx := database.C.Begin()
 
+	children, err := SaveDerivedAttachments(tx, &file, derived)
+	if err != nil {
+		tx.Rollback()
+		discardDerivedAttachments(children)
+		return err
+	}
+
 	if err := tx.Model(&file).Updates(&models.Attachment{
-		IsAnalyzed: true,
-		Metadata:   file.Metadata,
+		IsAnalyzed:      true,
+		Size:            file.Size,
+		HashCode:        file.HashCode,
+		Metadata:        file.Metadata,
+		PrivateMetadata: file.PrivateMetadata,
+		ScannedAt:       file.ScannedAt,
+		ThumbnailID:     file.ThumbnailID,
+		CompressedID:    file.CompressedID,
+		ContentText:     file.ContentText,
+		PerceptualHash:  file.PerceptualHash,
+		DominantColor:   file.DominantColor,
+
+		PerceptualHashBand0: file.PerceptualHashBand0,
+		PerceptualHashBand1: file.PerceptualHashBand1,
+		PerceptualHashBand2: file.PerceptualHashBand2,
+		PerceptualHashBand3: file.PerceptualHashBand3,
 	}).Error; err != nil {
 		tx.Rollback()
+		discardDerivedAttachments(children)
 		return fmt.Errorf("unable to update file record: %v", err)
 	}
 
 	linked, err := TryLinkAttachment(tx, file, file.HashCode)
 	if linked && err != nil {
+		tx.Rollback()
+		discardDerivedAttachments(children)
 		return fmt.Errorf("unable to link file record: %v", err)
 	}
 
-	tx.Commit()
+	if err := SetAttachmentStatus(tx, &file, lo.Ternary(linked, models.AttachmentStatusReady, models.AttachmentStatusTransferring)); err != nil {
+		tx.Rollback()
+		discardDerivedAttachments(children)
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		discardDerivedAttachments(children)
+		return fmt.Errorf("unable to update file record: %v", err)
+	}
+
+	for _, child := range children {
+		PublishAnalyzeTask(child, priority...)
+	}
 
 	log.Info().Dur("elapsed", time.Since(start)).Uint("id", file.ID).Msg("A file analyze task was finished, starting uploading...")
+	PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventAnalyzed, file, map[string]any{"metadata": file.Metadata}))
 
 	// Move temporary to permanent
 	if !linked {
-		go func() {
-			start = time.Now()
-			if err := ReUploadFile(file, 1); err != nil {
-				log.Warn().Any("file", file).Err(err).Msg("Unable to move file to permanet storage...")
-			} else {
-				// Recycle the temporary file
-				file.Destination = models.AttachmentDstTemporary
-				go fs.DeleteFile(file)
-				// Finish
-				log.Info().Dur("elapsed", time.Since(start)).Uint("id", file.ID).Msg("A file post-analyze upload task was finished.")
-			}
-		}()
+		PublishTransferTask(file, 1, priority...)
 	} else {
 		log.Info().Uint("id", file.ID).Msg("File is linked to exists one, skipping uploading...")
+		PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventReady, file))
+	}
+
+	return nil
+}
+
+// TransferAttachment moves the analyzed file from the temporary storage to the permanent storage
+func TransferAttachment(file models.Attachment, dst int) error {
+	start := time.Now()
+	PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventTransferring, file, map[string]any{"destination": dst}))
+
+	prevDst := file.Destination
+	if err := ReUploadFile(file, dst); err != nil {
+		return fmt.Errorf("unable to move file to destination %d: %v", dst, err)
+	}
+
+	if prevDst == models.AttachmentDstTemporary {
+		// Recycle the temporary file
+		go fs.DeleteFile(file)
+	}
+
+	file.Destination = dst
+	if err := SetAttachmentStatus(database.C, &file, models.AttachmentStatusReady); err != nil {
+		return err
 	}
 
+	log.Info().Dur("elapsed", time.Since(start)).Uint("id", file.ID).Msg("A file transfer task was finished.")
+	PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventReady, file))
+
+	if ShouldTranscodeAttachment(file) {
+		PublishTranscodeTask(file)
+	}
+
+	return nil
+}
+
+// QuarantineAttachment marks the file as infected
+// The file will stay in the temporary storage and never be moved, linked or opened
+func QuarantineAttachment(file models.Attachment, signature string) error {
+	if !file.CanTransitTo(models.AttachmentStatusQuarantined) {
+		return fmt.Errorf("attachment status cannot be changed from %s to %s", file.Status, models.AttachmentStatusQuarantined)
+	}
+	if err := database.C.Model(&file).Updates(map[string]any{
+		"status":         models.AttachmentStatusQuarantined,
+		"failure_reason": "the file was flagged by the malware scanner",
+		"is_quarantined": true,
+		"is_analyzed":    true,
+		"scan_verdict":   signature,
+		"scanned_at":     lo.Ternary(file.ScannedAt != nil, file.ScannedAt, lo.ToPtr(time.Now())),
+		"hash_code":      file.HashCode,
+	}).Error; err != nil {
+		return fmt.Errorf("unable to quarantine file: %v", err)
+	}
 	return nil
 }
 
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	limits := AttachmentAnalyzerLimits{Timeout: 120 * time.Second}
+	RegisterAttachmentAnalyzer("image/gif", animationAnalyzer{}, limits)
+	RegisterAttachmentAnalyzer("image/png", animationAnalyzer{}, limits)
+	RegisterAttachmentAnalyzer("image/apng", animationAnalyzer{}, limits)
+	RegisterAttachmentAnalyzer("image/webp", animationAnalyzer{}, limits)
+}
+
+// animationRendition is a video format the animated images can be transcoded into
+type animationRendition struct {
+	MimeType string
+	Ext      string
+	Args     []string
+}
+
+// The renditions are listed in the same order as the compressed formats, the last one is the most compatible
+// The videos cannot keep the transparency, the transparent pixels will be black
+var animationRenditions = []animationRendition{
+	{
+		MimeType: "video/webm",
+		Ext:      ".webm",
+		Args:     []string{"-c:v", "libvpx-vp9", "-crf", "35", "-b:v", "0", "-row-mt", "1"},
+	},
+	{
+		MimeType: "video/mp4",
+		Ext:      ".mp4",
+		Args:     []string{"-c:v", "libx264", "-crf", "23", "-preset", "medium", "-movflags", "+faststart"},
+	},
+}
+
+// getAnimationTranscodeMinSize returns the size of the animated images worth transcoding into the videos
+func getAnimationTranscodeMinSize() int64 {
+	if val := viper.GetInt64("analyzers.animation.transcode_min_size"); val > 0 {
+		return val
+	}
+	return 1 << 20
+}
+
+// animationAnalyzer reads the frames and the timing of the animated images
+// The large GIFs will be transcoded into the videos as the compressed version for the pools enabled it
+type animationAnalyzer struct{}
+
+func (animationAnalyzer) Name() string {
+	return "animation"
+}
+
+func (animationAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	anim, err := probeImageAnimation(target.Path, target.File.MimeType)
+	if err != nil {
+		return nil, err
+	} else if anim == nil {
+		return map[string]any{"animated": false}, nil
+	}
+
+	metadata := map[string]any{
+		"animated":    true,
+		"frame_count": anim.FrameCount,
+		"loop_count":  anim.LoopCount,
+		"duration":    math.Round(anim.Duration*1000) / 1000,
+	}
+
+	if target.File.ParentID != nil || target.File.Type != models.AttachmentTypeNormal {
+		return metadata, nil
+	} else if target.File.Pool == nil || !target.File.Pool.Config.Data().TranscodeAnimations {
+		return metadata, nil
+	} else if !matchMimeType("image/gif", target.File.MimeType) || target.File.Size < getAnimationTranscodeMinSize() {
+		return metadata, nil
+	} else if !isToolAvailable("ffmpeg") {
+		return metadata, nil
+	}
+
+	var generated []AttachmentDerivedFile
+	renditions := make(map[string]string)
+	for _, rendition := range animationRenditions {
+		out := filepath.Join(target.WorkDir, "animation"+rendition.Ext)
+		args := []string{"-v", "error", "-i", target.Path, "-an", "-pix_fmt", "yuv420p",
+			// The encoders only take the even sizes
+			"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2"}
+		args = append(append(args, rendition.Args...), out)
+		if _, err := runToolCommand(ctx, "ffmpeg", args...); err != nil {
+			log.Warn().Err(err).Uint("id", target.File.ID).Str("format", rendition.MimeType).Msg("Unable to transcode animation into video...")
+			continue
+		}
+
+		// Keep the original if the video doesn't help
+		encoded, err := os.Stat(out)
+		if err != nil || encoded.Size() >= target.File.Size {
+			continue
+		}
+
+		rid := RandString(16)
+		renditions[rendition.MimeType] = rid
+		generated = append(generated, AttachmentDerivedFile{
+			Path:     out,
+			Name:     strings.TrimSuffix(target.File.Name, filepath.Ext(target.File.Name)) + rendition.Ext,
+			MimeType: rendition.MimeType,
+			Type:     models.AttachmentTypeCompressed,
+			Metadata: map[string]any{"derived": "animation", "loop_count": anim.LoopCount},
+			Rid:      rid,
+		})
+	}
+
+	if len(generated) > 0 {
+		generated[len(generated)-1].IsCompressed = true
+		for _, item := range generated {
+			target.AddDerivedFile(item)
+		}
+		metadata["renditions"] = renditions
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+func init() {
+	RegisterAttachmentAnalyzer("audio/*", audioAnalyzer{}, AttachmentAnalyzerLimits{Timeout: 60 * time.Second})
+}
+
+var audioTagKeys = []string{"title", "artist", "album", "album_artist", "genre", "date", "track", "composer"}
+
+// The sample rate used to compute the waveform, high enough for drawing but keep the pcm stream small
+const waveformSampleRate = 8000
+
+type audioAnalyzer struct{}
+
+func (audioAnalyzer) Name() string {
+	return "audio"
+}
+
+func (audioAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	data, err := ffprobe.ProbeURL(ctx, target.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to analyze audio information: %v", err)
+	}
+
+	stream := data.FirstAudioStream()
+	if stream == nil {
+		return nil, fmt.Errorf("no audio stream found")
+	}
+
+	duration := data.Format.DurationSeconds
+	if val, err := strconv.ParseFloat(stream.Duration, 64); err == nil && val > 0 {
+		duration = val
+	}
+	bitRate, _ := strconv.ParseInt(data.Format.BitRate, 10, 64)
+	sampleRate, _ := strconv.Atoi(stream.SampleRate)
+
+	tags := make(map[string]any)
+	for k, v := range data.Format.TagList {
+		key := strings.ToLower(k)
+		for _, item := range audioTagKeys {
+			if key == item {
+				tags[key] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	metadata := map[string]any{
+		"duration":       duration,
+		"bit_rate":       bitRate,
+		"codec_name":     stream.CodecName,
+		"sample_rate":    sampleRate,
+		"channels":       stream.Channels,
+		"channel_layout": stream.ChannelLayout,
+		"tags":           tags,
+	}
+
+	points := viper.GetInt("analyzers.audio.waveform_points")
+	if points <= 0 {
+		points = 100
+	}
+	if peaks, err := computeWaveformPeaks(ctx, target.Path, duration, points); err != nil {
+		// The basic information is still useful without the waveform
+		log.Warn().Err(err).Uint("id", target.File.ID).Msg("Unable to compute waveform of audio...")
+	} else {
+		metadata["waveform"] = peaks
+	}
+
+	// The cover art is stored as a video stream with only one picture
+	for _, item := range data.StreamType(ffprobe.StreamVideo) {
+		if item.Disposition.AttachedPic != 1 {
+			continue
+		}
+		if cover, err := extractAudioCoverArt(ctx, target, item); err == nil {
+			target.AddDerivedFile(cover)
+			metadata["has_cover_art"] = true
+		}
+		break
+	}
+
+	return metadata, nil
+}
+
+// computeWaveformPeaks decodes the audio into mono pcm and takes the peak of each bucket
+// The peaks are normalized into 0 to 1, the amount of them will be the points or less
+func computeWaveformPeaks(ctx context.Context, path string, duration float64, points int) ([]float64, error) {
+	cmd := newToolCommand(ctx, "ffmpeg",
+		"-v", "error", "-i", path,
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(waveformSampleRate),
+		"-f", "s16le", "-acodec", "pcm_s16le", "-",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start ffmpeg: %v", err)
+	}
+
+	perBucket := int64(math.Ceil(duration * waveformSampleRate / float64(points)))
+	if perBucket <= 0 {
+		// Unknown duration, use 100ms buckets and merge them later
+		perBucket = waveformSampleRate / 10
+	}
+
+	var peaks []float64
+	var peak, count int64
+	buf := make([]byte, 32*1024)
+	var carry []byte
+	for {
+		n, readErr := stdout.Read(buf)
+		chunk := append(carry, buf[:n]...)
+		idx := 0
+		for ; idx+1 < len(chunk); idx += 2 {
+			sample := int64(int16(binary.LittleEndian.Uint16(chunk[idx:])))
+			if sample < 0 {
+				sample = -sample
+			}
+			peak = max(peak, sample)
+			count++
+			if count >= perBucket {
+				peaks = append(peaks, float64(peak))
+				peak, count = 0, 0
+			}
+		}
+		carry = append([]byte{}, chunk[idx:]...)
+
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			_ = cmd.Wait()
+			return nil, fmt.Errorf("unable to read pcm stream: %v", readErr)
+		}
+	}
+	if count > 0 {
+		peaks = append(peaks, float64(peak))
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("unable to decode audio: %v", err)
+	}
+
+	// The duration reported by the container can be inaccurate, merge the extra buckets
+	if len(peaks) > points {
+		group := int(math.Ceil(float64(len(peaks)) / float64(points)))
+		var merged []float64
+		for i := 0; i < len(peaks); i += group {
+			val := 0.0
+			for _, item := range peaks[i:min(i+group, len(peaks))] {
+				val = max(val, item)
+			}
+			merged = append(merged, val)
+		}
+		peaks = merged
+	}
+
+	for idx := range peaks {
+		peaks[idx] = math.Round(peaks[idx]/math.MaxInt16*1000) / 1000
+		peaks[idx] = min(peaks[idx], 1)
+	}
+
+	return peaks, nil
+}
+
+func extractAudioCoverArt(ctx context.Context, target AttachmentAnalyzeTarget, stream ffprobe.Stream) (AttachmentDerivedFile, error) {
+	ext, mimetype := ".png", "image/png"
+	args := []string{"-v", "error", "-i", target.Path, "-map", fmt.Sprintf("0:%d", stream.Index), "-frames:v", "1"}
+	switch stream.CodecName {
+	case "mjpeg":
+		ext, mimetype = ".jpg", "image/jpeg"
+		args = append(args, "-c", "copy")
+	case "png":
+		args = append(args, "-c", "copy")
+	default:
+		args = append(args, "-c:v", "png")
+	}
+
+	out := filepath.Join(target.WorkDir, "cover"+ext)
+	args = append(args, "-f", "image2", "-y", out)
+	if _, err := runToolCommand(ctx, "ffmpeg", args...); err != nil {
+		return AttachmentDerivedFile{}, err
+	}
+
+	return AttachmentDerivedFile{
+		Path:        out,
+		Name:        strings.TrimSuffix(target.File.Name, filepath.Ext(target.File.Name)) + ".cover" + ext,
+		MimeType:    mimetype,
+		Type:        models.AttachmentTypeThumbnail,
+		Metadata:    map[string]any{"derived": "cover_art"},
+		IsThumbnail: true,
+	}, nil
+}
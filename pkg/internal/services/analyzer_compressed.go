@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	limits := AttachmentAnalyzerLimits{Timeout: 120 * time.Second}
+	RegisterAttachmentAnalyzer("image/jpeg", compressedAnalyzer{}, limits)
+	RegisterAttachmentAnalyzer("image/png", compressedAnalyzer{}, limits)
+}
+
+// compressedFormat is a modern image format generated by an external encoder
+type compressedFormat struct {
+	MimeType string
+	Ext      string
+	Tool     string
+	Args     func(quality int, in, out string) []string
+}
+
+// The formats are listed in the order of preference, the clients accept the former will get it first
+// The last one is the most compatible, it will be used as the compressed version of the original
+var compressedFormats = []compressedFormat{
+	{
+		MimeType: "image/avif",
+		Ext:      ".avif",
+		Tool:     "avifenc",
+		Args: func(quality int, in, out string) []string {
+			return []string{"-q", strconv.Itoa(quality), "-s", "6", "--ignore-exif", "--ignore-xmp", in, out}
+		},
+	},
+	{
+		MimeType: "image/webp",
+		Ext:      ".webp",
+		Tool:     "cwebp",
+		Args: func(quality int, in, out string) []string {
+			return []string{"-quiet", "-q", strconv.Itoa(quality), "-metadata", "none", in, "-o", out}
+		},
+	},
+}
+
+func getCompressedQuality(format compressedFormat) int {
+	quality := viper.GetInt(fmt.Sprintf("analyzers.compressed.%s_quality", strings.TrimPrefix(format.Ext, ".")))
+	if quality <= 0 || quality > 100 {
+		quality = 75
+	}
+	return quality
+}
+
+// compressedAnalyzer encodes the images into the modern formats, only for the pools enabled it
+// The formats whose encoder isn't installed will be skipped
+type compressedAnalyzer struct{}
+
+func (compressedAnalyzer) Name() string {
+	return "compressed"
+}
+
+func (compressedAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	if target.File.ParentID != nil || target.File.Type != models.AttachmentTypeNormal {
+		return nil, nil
+	} else if target.File.Pool == nil || !target.File.Pool.Config.Data().EnableCompression {
+		return nil, nil
+	} else if isAnimatedImageFile(target.Path, target.File.MimeType) {
+		// The encoders only take the first frame of the APNG, the animation analyzer handles them
+		return nil, nil
+	}
+
+	stat, err := os.Stat(target.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file: %v", err)
+	}
+
+	// The encoders ignore the EXIF orientation, feed them the upright pixels instead
+	input := target.Path
+	if readImageOrientation(ctx, target.Path, target.File.MimeType) > 1 {
+		im, err := decodeImageFile(ctx, target.File, target.Path, target.WorkDir)
+		if err != nil {
+			return nil, err
+		}
+		input = filepath.Join(target.WorkDir, "compressed-input.png")
+		writer, err := os.Create(input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create file: %v", err)
+		}
+		err = png.Encode(writer, im)
+		writer.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode image: %v", err)
+		}
+	}
+
+	var generated []AttachmentDerivedFile
+	formats := make(map[string]string)
+	for _, format := range compressedFormats {
+		if !isToolAvailable(format.Tool) {
+			continue
+		}
+
+		out := filepath.Join(target.WorkDir, "compressed"+format.Ext)
+		quality := getCompressedQuality(format)
+		if _, err := runToolCommand(ctx, format.Tool, format.Args(quality, input, out)...); err != nil {
+			log.Warn().Err(err).Uint("id", target.File.ID).Str("format", format.MimeType).Msg("Unable to encode image into the compressed format...")
+			continue
+		}
+
+		// Keep the original if the modern format doesn't help
+		encoded, err := os.Stat(out)
+		if err != nil || encoded.Size() >= stat.Size() {
+			continue
+		}
+
+		rid := RandString(16)
+		formats[format.MimeType] = rid
+		generated = append(generated, AttachmentDerivedFile{
+			Path:     out,
+			Name:     strings.TrimSuffix(target.File.Name, filepath.Ext(target.File.Name)) + format.Ext,
+			MimeType: format.MimeType,
+			Type:     models.AttachmentTypeCompressed,
+			Metadata: map[string]any{"derived": "compressed", "quality": quality},
+			Rid:      rid,
+		})
+	}
+
+	if len(generated) == 0 {
+		return nil, nil
+	}
+	generated[len(generated)-1].IsCompressed = true
+	for _, item := range generated {
+		target.AddDerivedFile(item)
+	}
+
+	return map[string]any{"formats": formats}, nil
+}
+
+// NegotiateAttachmentRendition picks the compressed rendition the client accepts by the Accept header
+// The rid of the original will be returned if there is no suitable one
+func NegotiateAttachmentRendition(rid string, accept string) string {
+	// Don't look up the attachment for the clients accept none of the formats
+	accepted := lo.Filter(compressedFormats, func(format compressedFormat, _ int) bool {
+		return isMimeTypeAccepted(accept, format.MimeType)
+	})
+	if len(accepted) == 0 {
+		return rid
+	}
+
+	file, err := GetAttachmentByRID(rid)
+	if err != nil {
+		return rid
+	} else if file.Pool == nil || !file.Pool.Config.Data().EnableCompression {
+		return rid
+	}
+	formats := cast.ToStringMapString(cast.ToStringMap(file.Metadata["compressed"])["formats"])
+	for _, format := range accepted {
+		if target, ok := formats[format.MimeType]; ok {
+			return target
+		}
+	}
+	return rid
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/spf13/viper"
+)
+
+// The office formats can only be analyzed after converted into pdf by the converter configured
+var officeMimeTypes = []string{
+	"application/msword",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.ms-excel",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/vnd.oasis.opendocument.text",
+	"application/vnd.oasis.opendocument.spreadsheet",
+	"application/vnd.oasis.opendocument.presentation",
+	"application/rtf",
+}
+
+func init() {
+	limits := AttachmentAnalyzerLimits{Timeout: 60 * time.Second}
+	RegisterAttachmentAnalyzer("application/pdf", documentAnalyzer{}, limits)
+	for _, item := range officeMimeTypes {
+		RegisterAttachmentAnalyzer(item, documentAnalyzer{}, limits)
+	}
+}
+
+// documentAnalyzer reads the pdf with the poppler utils
+// The office documents will be converted to pdf by the converter like "soffice" first if configured
+type documentAnalyzer struct{}
+
+func (documentAnalyzer) Name() string {
+	return "document"
+}
+
+func (documentAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	path := target.Path
+	metadata := map[string]any{}
+
+	if !matchMimeType("application/pdf", target.File.MimeType) {
+		converter := viper.GetString("analyzers.document.converter")
+		if len(converter) == 0 {
+			return nil, nil
+		}
+		converted, err := convertDocumentToPdf(ctx, converter, target)
+		if err != nil {
+			return nil, err
+		}
+		path = converted
+		metadata["converted"] = true
+	}
+
+	info, err := runToolCommand(ctx, "pdfinfo", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read document information: %v", err)
+	}
+	fields := parsePdfInfo(info)
+
+	pages, _ := strconv.Atoi(fields["Pages"])
+	encrypted := strings.HasPrefix(strings.ToLower(fields["Encrypted"]), "yes")
+	metadata["pages"] = pages
+	metadata["title"] = fields["Title"]
+	metadata["author"] = fields["Author"]
+	metadata["encrypted"] = encrypted
+
+	if thumbnail, err := renderDocumentFirstPage(ctx, path, target); err == nil {
+		target.AddDerivedFile(thumbnail)
+		metadata["has_preview"] = true
+	}
+
+	if text, err := extractDocumentText(ctx, path); err == nil && len(text) > 0 {
+		target.SetContentText(text)
+	}
+
+	return metadata, nil
+}
+
+func parsePdfInfo(out []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return fields
+}
+
+func convertDocumentToPdf(ctx context.Context, converter string, target AttachmentAnalyzeTarget) (string, error) {
+	// The converter decides the output name by the input name, give it a name with the correct extension
+	ext := filepath.Ext(target.File.Name)
+	input := filepath.Join(target.WorkDir, "document"+ext)
+	if err := os.Symlink(target.Path, input); err != nil {
+		return "", fmt.Errorf("unable to prepare document: %v", err)
+	}
+
+	// Isolate the profile of the converter, the concurrent conversions will conflict with a shared one
+	profile := "file://" + filepath.Join(target.WorkDir, "profile")
+	if _, err := runToolCommand(ctx, converter,
+		"-env:UserInstallation="+profile,
+		"--headless", "--convert-to", "pdf", "--outdir", target.WorkDir, input,
+	); err != nil {
+		return "", fmt.Errorf("unable to convert document: %v", err)
+	}
+
+	out := filepath.Join(target.WorkDir, "document.pdf")
+	if _, err := os.Stat(out); err != nil {
+		return "", fmt.Errorf("converter didn't produce the pdf: %v", err)
+	}
+	return out, nil
+}
+
+func renderDocumentFirstPage(ctx context.Context, path string, target AttachmentAnalyzeTarget) (AttachmentDerivedFile, error) {
+	size := viper.GetInt("analyzers.document.preview_size")
+	if size <= 0 {
+		size = 1024
+	}
+
+	prefix := filepath.Join(target.WorkDir, "preview")
+	if _, err := runToolCommand(ctx, "pdftoppm",
+		"-f", "1", "-l", "1", "-singlefile",
+		"-png", "-scale-to", strconv.Itoa(size),
+		path, prefix,
+	); err != nil {
+		return AttachmentDerivedFile{}, err
+	}
+
+	return AttachmentDerivedFile{
+		Path:        prefix + ".png",
+		Name:        strings.TrimSuffix(target.File.Name, filepath.Ext(target.File.Name)) + ".preview.png",
+		MimeType:    "image/png",
+		Type:        models.AttachmentTypeThumbnail,
+		Metadata:    map[string]any{"derived": "document_preview"},
+		IsThumbnail: true,
+	}, nil
+}
+
+// extractDocumentText extracts the text of the first pages, and truncates it by the limit
+func extractDocumentText(ctx context.Context, path string) (string, error) {
+	maxPages := viper.GetInt("analyzers.document.max_text_pages")
+	if maxPages <= 0 {
+		maxPages = 50
+	}
+	maxLength := viper.GetInt("analyzers.document.max_text_length")
+	if maxLength <= 0 {
+		maxLength = 1 << 20
+	}
+
+	out, err := runToolCommand(ctx, "pdftotext", "-l", strconv.Itoa(maxPages), "-enc", "UTF-8", path, "-")
+	if err != nil {
+		return "", err
+	}
+
+	// The database doesn't accept the null character in text
+	out = bytes.ReplaceAll(bytes.ToValidUTF8(out, nil), []byte{0}, nil)
+	text := strings.Join(strings.Fields(string(out)), " ")
+	if len(text) > maxLength {
+		text = text[:maxLength]
+		// Don't cut a character in half
+		for len(text) > 0 && !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text, nil
+}
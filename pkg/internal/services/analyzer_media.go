@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/samber/lo"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+func init() {
+	RegisterAttachmentAnalyzer("image/*", imageAnalyzer{}, AttachmentAnalyzerLimits{Timeout: 30 * time.Second})
+	RegisterAttachmentAnalyzer("video/*", videoAnalyzer{}, AttachmentAnalyzerLimits{Timeout: 30 * time.Second})
+	RegisterAttachmentAnalyzer("image/*", exifAnalyzer{}, AttachmentAnalyzerLimits{Timeout: 10 * time.Second})
+	RegisterAttachmentAnalyzer("video/*", exifAnalyzer{}, AttachmentAnalyzerLimits{Timeout: 10 * time.Second})
+}
+
+type imageAnalyzer struct{}
+
+func (imageAnalyzer) Name() string {
+	return "image"
+}
+
+func (imageAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	// Read the size from the header, the images too large to decode still have it
+	width, height, err := probeImageSize(target.Path, target.File.MimeType)
+	if err != nil {
+		return nil, err
+	}
+	// Report the size as displayed, the clients lay out the images by it
+	orientation := readImageOrientation(ctx, target.Path, target.File.MimeType)
+	if isOrientationTransposed(orientation) {
+		width, height = height, width
+	}
+	metadata := map[string]any{
+		"width":       width,
+		"height":      height,
+		"ratio":       float64(width) / float64(height),
+		"orientation": orientation,
+	}
+
+	im, err := decodeImageFile(ctx, target.File, target.Path, target.WorkDir)
+	if err != nil {
+		metadata["decode_error"] = err.Error()
+		return metadata, nil
+	}
+	// Each stage scales the whole image down, stop between them after timed out
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if hash, err := encodeBlurHash(im); err == nil {
+		metadata["blurhash"] = hash
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if palette := extractPalette(im); len(palette) > 0 {
+		metadata["dominant_color"] = palette[0]
+		metadata["palette"] = palette
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	target.SetPerceptualHash(computeDHash(im))
+	return metadata, nil
+}
+
+type videoAnalyzer struct{}
+
+func (videoAnalyzer) Name() string {
+	return "video"
+}
+
+func (videoAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	data, err := ffprobe.ProbeURL(ctx, target.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to analyze video information: %v", err)
+	}
+
+	stream := data.FirstVideoStream()
+	if stream == nil {
+		return nil, fmt.Errorf("no video stream found")
+	}
+	duration, _ := strconv.ParseFloat(stream.Duration, 64)
+	metadata := map[string]any{
+		"width":       stream.Width,
+		"height":      stream.Height,
+		"ratio":       float64(stream.Width) / float64(stream.Height),
+		"duration":    duration,
+		"bit_rate":    stream.BitRate,
+		"codec_name":  stream.CodecName,
+		"color_range": stream.ColorRange,
+		"color_space": stream.ColorSpace,
+	}
+	// Use the key frame at the same position as the poster for the placeholder and the perceptual hash
+	if frame, err := extractVideoFrame(ctx, target.Path, min(duration/10, 10), blurHashSampleSize); err == nil {
+		if hash, err := encodeBlurHash(frame); err == nil {
+			metadata["blurhash"] = hash
+		}
+		target.SetPerceptualHash(computeDHash(frame))
+	}
+	return metadata, nil
+}
+
+var exifWhitelist = []string{
+	"Model", "ShutterSpeed", "ISO", "Megapixels", "Aperture",
+	"ColorSpace", "ColorTemperature", "ColorTone", "Contrast",
+	"ExposureTime", "FNumber", "FocalLength", "Flash", "HDREffect",
+	"LensModel",
+}
+
+// exifAnalyzer picks the camera information from the EXIF data
+// The pools keep all the metadata expose every embedded field, and the ones strip all expose nothing even if the file wasn't rewritten
+type exifAnalyzer struct{}
+
+func (exifAnalyzer) Name() string {
+	return "exif"
+}
+
+func (exifAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	policy := models.MetadataPolicyStripLocation
+	if target.File.Pool != nil {
+		policy = target.File.Pool.Config.Data().GetMetadataPolicy()
+	}
+	if policy == models.MetadataPolicyStripAll {
+		return nil, nil
+	}
+
+	fields, err := readFileMetadata(target.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]any)
+	for key, val := range fields {
+		group, tag := splitMetadataKey(key)
+		if policy == models.MetadataPolicyKeepAll {
+			// The binary fields are only placeholders like (Binary data 1024 bytes), skip them
+			if !lo.Contains(metadataFileGroups, group) && !strings.HasPrefix(fmt.Sprint(val), "(Binary data") {
+				out[tag] = val
+			}
+		} else if lo.Contains(exifWhitelist, tag) {
+			out[tag] = val
+		}
+	}
+	return out, nil
+}
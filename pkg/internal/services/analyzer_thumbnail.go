@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+	"golang.org/x/image/draw"
+)
+
+func init() {
+	RegisterAttachmentAnalyzer("image/*", thumbnailAnalyzer{}, AttachmentAnalyzerLimits{Timeout: 60 * time.Second})
+}
+
+// getThumbnailSizes returns the length of the longest side of each thumbnail
+// The first one will be used as the thumbnail of the original
+func getThumbnailSizes() []int {
+	sizes := viper.GetIntSlice("analyzers.thumbnail.sizes")
+	if len(sizes) == 0 {
+		sizes = []int{256, 1024}
+	}
+	return sizes
+}
+
+// thumbnailAnalyzer generates the smaller versions of the images as the child attachments
+type thumbnailAnalyzer struct{}
+
+func (thumbnailAnalyzer) Name() string {
+	return "thumbnail"
+}
+
+func (thumbnailAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	if target.File.ParentID != nil || target.File.Type != models.AttachmentTypeNormal {
+		// Don't make thumbnails of the thumbnails
+		return nil, nil
+	}
+
+	im, err := decodeImageFile(ctx, target.File, target.Path, target.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := append([]int{}, getThumbnailSizes()...)
+	primary := sizes[0]
+	sort.Ints(sizes)
+
+	var generated []int
+	for _, size := range sizes {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		bounds := im.Bounds()
+		if max(bounds.Dx(), bounds.Dy()) <= size {
+			// The original is small enough, the bigger ones are not needed either
+			break
+		}
+
+		derived, err := writeThumbnail(im, size, target)
+		if err != nil {
+			return nil, err
+		}
+		derived.IsThumbnail = size == primary
+		target.AddDerivedFile(derived)
+		generated = append(generated, size)
+	}
+
+	// The animated images always need a static thumbnail, the clients show it before playing
+	if !lo.Contains(generated, primary) && isAnimatedImageFile(target.Path, target.File.MimeType) {
+		bounds := im.Bounds()
+		size := min(primary, max(bounds.Dx(), bounds.Dy()))
+		derived, err := writeThumbnail(im, size, target)
+		if err != nil {
+			return nil, err
+		}
+		derived.IsThumbnail = true
+		target.AddDerivedFile(derived)
+		generated = append(generated, size)
+	}
+
+	return map[string]any{"sizes": generated}, nil
+}
+
+// resizeImage scales the image to make its longest side fit the size
+func resizeImage(im image.Image, size int) image.Image {
+	bounds := im.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(out, out.Bounds(), im, bounds, draw.Src, nil)
+	return out
+}
+
+// isImageOpaque reports the image has no transparent pixels, then it can be encoded as jpeg
+func isImageOpaque(im image.Image) bool {
+	if val, ok := im.(interface{ Opaque() bool }); ok {
+		return val.Opaque()
+	}
+	return false
+}
+
+func writeThumbnail(im image.Image, size int, target AttachmentAnalyzeTarget) (AttachmentDerivedFile, error) {
+	thumbnail := resizeImage(im, size)
+
+	ext, mimetype := ".png", "image/png"
+	if isImageOpaque(im) {
+		ext, mimetype = ".jpg", "image/jpeg"
+	}
+
+	path := filepath.Join(target.WorkDir, fmt.Sprintf("thumbnail-%d%s", size, ext))
+	out, err := os.Create(path)
+	if err != nil {
+		return AttachmentDerivedFile{}, fmt.Errorf("unable to create thumbnail: %v", err)
+	}
+	defer out.Close()
+
+	if ext == ".jpg" {
+		err = jpeg.Encode(out, thumbnail, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(out, thumbnail)
+	}
+	if err != nil {
+		return AttachmentDerivedFile{}, fmt.Errorf("unable to encode thumbnail: %v", err)
+	}
+
+	bounds := thumbnail.Bounds()
+	return AttachmentDerivedFile{
+		Path:     path,
+		Name:     fmt.Sprintf("%s.%d%s", strings.TrimSuffix(target.File.Name, filepath.Ext(target.File.Name)), size, ext),
+		MimeType: mimetype,
+		Type:     models.AttachmentTypeThumbnail,
+		Metadata: map[string]any{
+			"derived": "thumbnail",
+			"size":    size,
+			"width":   bounds.Dx(),
+			"height":  bounds.Dy(),
+			"ratio":   float64(bounds.Dx()) / float64(bounds.Dy()),
+		},
+	}, nil
+}
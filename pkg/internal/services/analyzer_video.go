@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+func init() {
+	RegisterAttachmentAnalyzer("video/*", videoPreviewAnalyzer{}, AttachmentAnalyzerLimits{Timeout: 120 * time.Second})
+}
+
+// videoPreviewAnalyzer extracts the poster frame as the thumbnail,
+// and generates the sprite sheet with a WebVTT index for the hover-scrub previews
+type videoPreviewAnalyzer struct{}
+
+func (videoPreviewAnalyzer) Name() string {
+	return "video_preview"
+}
+
+func (videoPreviewAnalyzer) Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error) {
+	if target.File.ParentID != nil || target.File.Type != models.AttachmentTypeNormal {
+		return nil, nil
+	}
+
+	data, err := ffprobe.ProbeURL(ctx, target.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to analyze video information: %v", err)
+	}
+	stream := data.FirstVideoStream()
+	if stream == nil {
+		return nil, fmt.Errorf("no video stream found")
+	}
+
+	duration := data.Format.DurationSeconds
+	if val, err := strconv.ParseFloat(stream.Duration, 64); err == nil && val > 0 {
+		duration = val
+	}
+
+	metadata := make(map[string]any)
+
+	poster, err := extractVideoPoster(ctx, target, duration)
+	if err != nil {
+		return nil, err
+	}
+	target.AddDerivedFile(poster)
+	metadata["poster"] = true
+
+	if duration <= 0 || stream.Width <= 0 || stream.Height <= 0 {
+		// Cannot place the frames without knowing the length and the size
+		return metadata, nil
+	}
+	if sprite, err := generateVideoSprite(ctx, target, duration, float64(stream.Width)/float64(stream.Height)); err != nil {
+		// The poster is still useful without the sprite
+		log.Warn().Err(err).Uint("id", target.File.ID).Msg("Unable to generate sprite of video...")
+	} else {
+		metadata["sprite"] = sprite
+	}
+
+	return metadata, nil
+}
+
+// extractVideoPoster takes a frame near the beginning, skip the very first frames because they are often black
+func extractVideoPoster(ctx context.Context, target AttachmentAnalyzeTarget, duration float64) (AttachmentDerivedFile, error) {
+	size := viper.GetInt("analyzers.video_preview.poster_size")
+	if size <= 0 {
+		size = 1280
+	}
+
+	offset := math.Min(duration/10, 10)
+	out := filepath.Join(target.WorkDir, "poster.jpg")
+	args := []string{
+		"-v", "error",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64), "-i", target.Path,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", size, size),
+		"-q:v", "3", "-f", "image2", "-y", out,
+	}
+	if _, err := runToolCommand(ctx, "ffmpeg", args...); err != nil {
+		return AttachmentDerivedFile{}, fmt.Errorf("unable to extract poster frame: %v", err)
+	}
+	if _, err := os.Stat(out); err != nil && offset > 0 {
+		// Seeking beyond the end produces nothing when the duration is inaccurate, use the first frame instead
+		args[3] = "0"
+		if _, err := runToolCommand(ctx, "ffmpeg", args...); err != nil {
+			return AttachmentDerivedFile{}, fmt.Errorf("unable to extract poster frame: %v", err)
+		}
+	}
+
+	return AttachmentDerivedFile{
+		Path:        out,
+		Name:        strings.TrimSuffix(target.File.Name, filepath.Ext(target.File.Name)) + ".poster.jpg",
+		MimeType:    "image/jpeg",
+		Type:        models.AttachmentTypeThumbnail,
+		Metadata:    map[string]any{"derived": "poster", "offset": offset},
+		IsThumbnail: true,
+	}, nil
+}
+
+// generateVideoSprite puts the frames taken at a fixed interval into one image,
+// the WebVTT index refers to the sprite by its rid, it resolves to the sprite relative to the index url
+func generateVideoSprite(ctx context.Context, target AttachmentAnalyzeTarget, duration float64, ratio float64) (map[string]any, error) {
+	tileWidth := viper.GetInt("analyzers.video_preview.sprite_tile_width")
+	if tileWidth <= 0 {
+		tileWidth = 160
+	}
+	maxTiles := viper.GetInt("analyzers.video_preview.sprite_max_tiles")
+	if maxTiles <= 0 {
+		maxTiles = 100
+	}
+	columns := viper.GetInt("analyzers.video_preview.sprite_columns")
+	if columns <= 0 {
+		columns = 10
+	}
+
+	// The interval grows with the duration to keep the sprite in a reasonable size
+	interval := math.Max(1, math.Ceil(duration/float64(maxTiles)))
+	count := int(math.Ceil(duration / interval))
+	columns = min(columns, count)
+	rows := int(math.Ceil(float64(count) / float64(columns)))
+	tileHeight := max(2, int(math.Round(float64(tileWidth)/ratio/2))*2)
+
+	out := filepath.Join(target.WorkDir, "sprite.jpg")
+	filter := fmt.Sprintf(
+		"fps=1/%s,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		strconv.FormatFloat(interval, 'f', -1, 64),
+		tileWidth, tileHeight, tileWidth, tileHeight,
+		columns, rows,
+	)
+	if _, err := runToolCommand(ctx, "ffmpeg",
+		"-v", "error", "-i", target.Path,
+		"-an", "-vf", filter, "-frames:v", "1",
+		"-q:v", "4", "-f", "image2", "-y", out,
+	); err != nil {
+		return nil, fmt.Errorf("unable to generate sprite: %v", err)
+	}
+
+	spriteRid := RandString(16)
+	var index strings.Builder
+	index.WriteString("WEBVTT\n")
+	for idx := 0; idx < count; idx++ {
+		start := float64(idx) * interval
+		end := math.Min(start+interval, duration)
+		x, y := (idx%columns)*tileWidth, (idx/columns)*tileHeight
+		index.WriteString(fmt.Sprintf(
+			"\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVttTimestamp(start), formatVttTimestamp(end),
+			spriteRid, x, y, tileWidth, tileHeight,
+		))
+	}
+	indexPath := filepath.Join(target.WorkDir, "sprite.vtt")
+	if err := os.WriteFile(indexPath, []byte(index.String()), 0644); err != nil {
+		return nil, fmt.Errorf("unable to write sprite index: %v", err)
+	}
+
+	baseName := strings.TrimSuffix(target.File.Name, filepath.Ext(target.File.Name))
+	target.AddDerivedFile(AttachmentDerivedFile{
+		Path:     out,
+		Name:     baseName + ".sprite.jpg",
+		MimeType: "image/jpeg",
+		Type:     models.AttachmentTypeThumbnail,
+		Metadata: map[string]any{"derived": "sprite"},
+		Rid:      spriteRid,
+	})
+	indexRid := RandString(16)
+	target.AddDerivedFile(AttachmentDerivedFile{
+		Path:     indexPath,
+		Name:     baseName + ".sprite.vtt",
+		MimeType: "text/vtt",
+		Type:     models.AttachmentTypeThumbnail,
+		Metadata: map[string]any{"derived": "sprite_index", "sprite": spriteRid},
+		Rid:      indexRid,
+	})
+
+	return map[string]any{
+		"rid":         spriteRid,
+		"index":       indexRid,
+		"interval":    interval,
+		"count":       count,
+		"columns":     columns,
+		"rows":        rows,
+		"tile_width":  tileWidth,
+		"tile_height": tileHeight,
+	}, nil
+}
+
+func formatVttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+)
+
+// AttachmentAnalyzeTarget is the file handed to the analyzers
+// The file is in the temporary storage, the analyzers should treat it as read only
+// and write the files they generated into the work dir.
+type AttachmentAnalyzeTarget struct {
+	File    models.Attachment
+	Path    string
+	WorkDir string
+
+	outputs *attachmentAnalyzeOutputs
+}
+
+// AddDerivedFile submits a file generated from the attachment, it will become a child attachment
+func (v AttachmentAnalyzeTarget) AddDerivedFile(file AttachmentDerivedFile) {
+	v.outputs.Lock()
+	defer v.outputs.Unlock()
+	v.outputs.files = append(v.outputs.files, file)
+}
+
+// SetContentText submits the text extracted from the attachment for searching
+func (v AttachmentAnalyzeTarget) SetContentText(text string) {
+	v.outputs.Lock()
+	defer v.outputs.Unlock()
+	v.outputs.content = text
+}
+
+// SetPerceptualHash submits the perceptual hash of the attachment for finding the near-duplicates
+func (v AttachmentAnalyzeTarget) SetPerceptualHash(hash int64) {
+	v.outputs.Lock()
+	defer v.outputs.Unlock()
+	v.outputs.perceptualHash = &hash
+}
+
+type attachmentAnalyzeOutputs struct {
+	sync.Mutex
+	files   []AttachmentDerivedFile
+	content string
+
+	perceptualHash *int64
+}
+
+// merge takes the outputs of an analyzer finished successfully
+func (v *attachmentAnalyzeOutputs) merge(other *attachmentAnalyzeOutputs) {
+	v.Lock()
+	defer v.Unlock()
+	v.files = append(v.files, other.files...)
+	if len(other.content) > 0 {
+		v.content = other.content
+	}
+	if other.perceptualHash != nil {
+		v.perceptualHash = other.perceptualHash
+	}
+}
+
+// AttachmentAnalyzeResult is the merged output of all the analyzers
+// Call Cleanup after the derived files were saved to remove the work dir
+type AttachmentAnalyzeResult struct {
+	Metadata map[string]any
+	Derived  []AttachmentDerivedFile
+	Content  string
+	WorkDir  string
+
+	PerceptualHash *int64
+}
+
+func (v *AttachmentAnalyzeResult) Cleanup() {
+	if len(v.WorkDir) > 0 {
+		_ = os.RemoveAll(v.WorkDir)
+	}
+}
+
+// AttachmentAnalyzer computes metadata from the file content
+// The returned metadata will be stored under the name of the analyzer in the attachment metadata
+type AttachmentAnalyzer interface {
+	Name() string
+	Analyze(ctx context.Context, target AttachmentAnalyzeTarget) (map[string]any, error)
+}
+
+// AttachmentAnalyzerLimits are the resource limits of an analyzer
+// Every field can be overridden by the settings like analyzers.<name>.timeout
+// The external tools are killed after the timeout and run under the limits of prlimit,
+// the in-process decoders stop by the context and the image ones are bounded by analyzers.image.max_pixels
+type AttachmentAnalyzerLimits struct {
+	Timeout time.Duration
+	MaxSize int64 // The files larger than this will be skipped, zero means no limit
+}
+
+type attachmentAnalyzerEntry struct {
+	Pattern  string
+	Analyzer AttachmentAnalyzer
+	Limits   AttachmentAnalyzerLimits
+}
+
+var attachmentAnalyzers []attachmentAnalyzerEntry
+
+// These keys will be copied from the analyzers' metadata to the top level
+// The clients read the size of the media from here before the metadata was namespaced
+var sharedMetadataKeys = []string{"width", "height", "ratio", "duration", "blurhash", "dominant_color"}
+
+// RegisterAttachmentAnalyzer adds an analyzer for the files matching the mimetype pattern, like image/* or application/pdf
+// One analyzer can be registered with multiple patterns, it will only run once per file
+func RegisterAttachmentAnalyzer(pattern string, analyzer AttachmentAnalyzer, limits AttachmentAnalyzerLimits) {
+	attachmentAnalyzers = append(attachmentAnalyzers, attachmentAnalyzerEntry{
+		Pattern:  pattern,
+		Analyzer: analyzer,
+		Limits:   limits,
+	})
+}
+
+func getAttachmentAnalyzerLimits(entry attachmentAnalyzerEntry) AttachmentAnalyzerLimits {
+	limits := entry.Limits
+	prefix := fmt.Sprintf("analyzers.%s", entry.Analyzer.Name())
+	if val := viper.GetDuration(prefix + ".timeout"); val > 0 {
+		limits.Timeout = val
+	}
+	if val := viper.GetInt64(prefix + ".max_size"); val > 0 {
+		limits.MaxSize = val
+	}
+	if limits.Timeout <= 0 {
+		limits.Timeout = 30 * time.Second
+	}
+	return limits
+}
+
+// isAttachmentAnalyzerEnabled checks the analyzer against the settings and the config of the pool
+// The analyzers can be disabled globally by analyzers.<name>.disabled
+func isAttachmentAnalyzerEnabled(name string, pool *models.AttachmentPool) bool {
+	if viper.GetBool(fmt.Sprintf("analyzers.%s.disabled", name)) {
+		return false
+	}
+	if pool == nil {
+		return true
+	}
+
+	config := pool.Config.Data()
+	if len(config.EnabledAnalyzers) > 0 && !lo.Contains(config.EnabledAnalyzers, name) {
+		return false
+	}
+	return !lo.Contains(config.DisabledAnalyzers, name)
+}
+
+// getAttachmentAnalyzers returns the analyzers will be used for the file
+func getAttachmentAnalyzers(file models.Attachment) []attachmentAnalyzerEntry {
+	var out []attachmentAnalyzerEntry
+	for _, entry := range attachmentAnalyzers {
+		if !matchMimeType(entry.Pattern, file.MimeType) {
+			continue
+		} else if !isAttachmentAnalyzerEnabled(entry.Analyzer.Name(), file.Pool) {
+			continue
+		} else if lo.ContainsBy(out, func(item attachmentAnalyzerEntry) bool {
+			return item.Analyzer.Name() == entry.Analyzer.Name()
+		}) {
+			continue
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// runAttachmentAnalyzer runs the analyzer in place, it must not outlive the call since the work dir is removed after the analyzing
+// The outputs are only kept when the analyzer succeeded in time
+func runAttachmentAnalyzer(entry attachmentAnalyzerEntry, target AttachmentAnalyzeTarget) (metadata map[string]any, err error) {
+	limits := getAttachmentAnalyzerLimits(entry)
+	if limits.MaxSize > 0 && target.File.Size > limits.MaxSize {
+		return nil, fmt.Errorf("file is larger than the limit %d bytes", limits.MaxSize)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+
+	outputs := target.outputs
+	target.outputs = &attachmentAnalyzeOutputs{}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("analyzer panicked: %v", r)
+			}
+		}()
+		metadata, err = entry.Analyzer.Analyze(ctx, target)
+	}()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("analyzer timed out after %s", limits.Timeout)
+	} else if err != nil {
+		return nil, err
+	}
+
+	outputs.merge(target.outputs)
+	return metadata, nil
+}
+
+// RunAttachmentAnalyzers runs all the analyzers matched the file and merges their metadata.
+// The failure of one analyzer won't stop the others, the errors will be recorded in the analyze_errors key.
+func RunAttachmentAnalyzers(file models.Attachment, path string) (*AttachmentAnalyzeResult, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("attachment doesn't exists in temporary storage: %v", err)
+	}
+
+	// Keep the work dir in the same filesystem, so the derived files can be moved instead of copied
+	workDir, err := os.MkdirTemp(filepath.Dir(path), fmt.Sprintf(".%s-*", file.Uuid))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create work dir: %v", err)
+	}
+
+	target := AttachmentAnalyzeTarget{
+		File:    file,
+		Path:    path,
+		WorkDir: workDir,
+		outputs: &attachmentAnalyzeOutputs{},
+	}
+	metadata := make(map[string]any)
+	errs := make(map[string]string)
+
+	for _, entry := range getAttachmentAnalyzers(file) {
+		name := entry.Analyzer.Name()
+		start := time.Now()
+		meta, err := runAttachmentAnalyzer(entry, target)
+		if err != nil {
+			log.Warn().Err(err).Uint("id", file.ID).Str("analyzer", name).Msg("An analyzer failed...")
+			errs[name] = err.Error()
+			continue
+		}
+		log.Debug().Dur("elapsed", time.Since(start)).Uint("id", file.ID).Str("analyzer", name).Msg("An analyzer was finished.")
+
+		if meta == nil {
+			continue
+		}
+		metadata[name] = meta
+		for _, key := range sharedMetadataKeys {
+			if val, ok := meta[key]; ok {
+				if _, exists := metadata[key]; !exists {
+					metadata[key] = val
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		metadata["analyze_errors"] = errs
+	}
+
+	target.outputs.Lock()
+	defer target.outputs.Unlock()
+
+	return &AttachmentAnalyzeResult{
+		Metadata: metadata,
+		Derived:  target.outputs.files,
+		Content:  target.outputs.content,
+		WorkDir:  workDir,
+
+		PerceptualHash: target.outputs.perceptualHash,
+	}, nil
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/spf13/cast"
+)
+
+// imageAnimation is the timing of an animated image read from its container
+type imageAnimation struct {
+	FrameCount int
+	LoopCount  int     // How many times the animation plays, zero means forever
+	Duration   float64 // The seconds of one loop
+
+	// The frames of the WebP may be smaller than the canvas, only read for the WebP images
+	Canvas     image.Rectangle
+	FirstFrame image.Rectangle
+}
+
+// probeImageAnimation reads the animation of the GIF, APNG and WebP images without decoding the frames
+// Nothing will be returned for the static images, including the animated ones with only one frame
+func probeImageAnimation(path string, mimetype string) (*imageAnimation, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var anim *imageAnimation
+	switch {
+	case matchMimeType("image/gif", mimetype):
+		anim, err = probeGifAnimation(reader)
+	case matchMimeType("image/png", mimetype), matchMimeType("image/apng", mimetype):
+		anim, err = probePngAnimation(reader)
+	case matchMimeType("image/webp", mimetype):
+		anim, err = probeWebpAnimation(reader)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read animation: %v", err)
+	} else if anim == nil || anim.FrameCount <= 1 {
+		return nil, nil
+	}
+	return anim, nil
+}
+
+func isAnimatedImageFile(path string, mimetype string) bool {
+	anim, _ := probeImageAnimation(path, mimetype)
+	return anim != nil
+}
+
+// IsAnimatedAttachment reports the attachment was analyzed as an animated image
+func IsAnimatedAttachment(rid string) bool {
+	file, err := GetAttachmentByRID(rid)
+	if err != nil {
+		return false
+	}
+	return cast.ToBool(cast.ToStringMap(file.Metadata["animation"])["animated"])
+}
+
+// readChunkHead reads the first bytes of the chunk and skips the rest
+func readChunkHead(reader *bufio.Reader, length int, size int) ([]byte, error) {
+	if length < size {
+		return nil, fmt.Errorf("chunk is shorter than %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	if _, err := reader.Discard(length - size); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readGifSubBlocks reads the data sub-blocks until the terminator, the content is only kept if asked
+func readGifSubBlocks(reader *bufio.Reader, keep bool) ([][]byte, error) {
+	var blocks [][]byte
+	for {
+		size, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		} else if size == 0 {
+			return blocks, nil
+		}
+
+		if keep {
+			block := make([]byte, size)
+			if _, err := io.ReadFull(reader, block); err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		} else if _, err := reader.Discard(int(size)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func probeGifAnimation(reader *bufio.Reader) (*imageAnimation, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	} else if string(header[:3]) != "GIF" {
+		return nil, fmt.Errorf("invalid gif header")
+	}
+	if header[10]&0x80 != 0 {
+		// Global color table
+		if _, err := reader.Discard(3 << ((header[10] & 0x07) + 1)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The images without the NETSCAPE extension only play once
+	anim := &imageAnimation{LoopCount: 1}
+	delay := 0
+	for {
+		kind, err := reader.ReadByte()
+		if err == io.EOF {
+			// Many encoders forget the trailer, the frames read are still valid
+			return anim, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case 0x21: // Extension
+			label, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			blocks, err := readGifSubBlocks(reader, label == 0xF9 || label == 0xFF)
+			if err != nil {
+				return nil, err
+			}
+			if label == 0xF9 && len(blocks) > 0 && len(blocks[0]) >= 4 {
+				// Graphic control extension, the delay is in centiseconds
+				delay = int(binary.LittleEndian.Uint16(blocks[0][1:3]))
+			} else if label == 0xFF && len(blocks) > 1 && len(blocks[1]) >= 3 && blocks[1][0] == 1 {
+				// Application extension like NETSCAPE2.0, it stores how many times to repeat after the first play
+				if name := string(blocks[0]); name == "NETSCAPE2.0" || name == "ANIMEXTS1.0" {
+					if loops := int(binary.LittleEndian.Uint16(blocks[1][1:3])); loops == 0 {
+						anim.LoopCount = 0
+					} else {
+						anim.LoopCount = loops + 1
+					}
+				}
+			}
+		case 0x2C: // Image descriptor
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(reader, descriptor); err != nil {
+				return nil, err
+			}
+			if descriptor[8]&0x80 != 0 {
+				// Local color table
+				if _, err := reader.Discard(3 << ((descriptor[8] & 0x07) + 1)); err != nil {
+					return nil, err
+				}
+			}
+			// The minimum code size of LZW, then the image data
+			if _, err := reader.ReadByte(); err != nil {
+				return nil, err
+			}
+			if _, err := readGifSubBlocks(reader, false); err != nil {
+				return nil, err
+			}
+
+			// The browsers play the frames shorter than 20ms at 100ms
+			if delay < 2 {
+				delay = 10
+			}
+			anim.FrameCount++
+			anim.Duration += float64(delay) / 100
+			delay = 0
+		case 0x3B: // Trailer
+			return anim, nil
+		default:
+			return nil, fmt.Errorf("invalid gif block %#x", kind)
+		}
+	}
+}
+
+func probePngAnimation(reader *bufio.Reader) (*imageAnimation, error) {
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(reader, signature); err != nil {
+		return nil, err
+	} else if string(signature) != "\x89PNG\r\n\x1a\n" {
+		return nil, fmt.Errorf("invalid png signature")
+	}
+
+	var anim *imageAnimation
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint32(header[:4]))
+
+		switch string(header[4:8]) {
+		case "acTL": // Animation control, the image without it is a static one
+			data, err := readChunkHead(reader, length, 8)
+			if err != nil {
+				return nil, err
+			}
+			anim = &imageAnimation{
+				FrameCount: int(binary.BigEndian.Uint32(data[0:4])),
+				LoopCount:  int(binary.BigEndian.Uint32(data[4:8])),
+			}
+		case "fcTL": // Frame control, the delay is a fraction of seconds
+			data, err := readChunkHead(reader, length, 26)
+			if err != nil {
+				return nil, err
+			}
+			if anim != nil {
+				num, den := binary.BigEndian.Uint16(data[20:22]), binary.BigEndian.Uint16(data[22:24])
+				if den == 0 {
+					den = 100
+				}
+				anim.Duration += float64(num) / float64(den)
+			}
+		case "IEND":
+			return anim, nil
+		default:
+			if _, err := reader.Discard(length); err != nil {
+				return nil, err
+			}
+		}
+
+		// CRC
+		if _, err := reader.Discard(4); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func probeWebpAnimation(reader *bufio.Reader) (*imageAnimation, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	} else if string(header[:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("invalid webp header")
+	}
+
+	uint24 := func(data []byte) int {
+		return int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	}
+
+	var anim *imageAnimation
+	var canvas image.Rectangle
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, chunk); err == io.EOF {
+			return anim, nil
+		} else if err != nil {
+			return nil, err
+		}
+		// The chunks are padded to the even size
+		length := int(binary.LittleEndian.Uint32(chunk[4:8]))
+		length += length & 1
+
+		switch string(chunk[:4]) {
+		case "VP8X": // Extended header, the canvas size is stored minus one
+			data, err := readChunkHead(reader, length, 10)
+			if err != nil {
+				return nil, err
+			}
+			canvas = image.Rect(0, 0, uint24(data[4:7])+1, uint24(data[7:10])+1)
+		case "ANIM": // Animation parameters, the image without it is a static one
+			data, err := readChunkHead(reader, length, 6)
+			if err != nil {
+				return nil, err
+			}
+			anim = &imageAnimation{LoopCount: int(binary.LittleEndian.Uint16(data[4:6])), Canvas: canvas}
+		case "ANMF": // Frame, the duration is in milliseconds, the offset is stored halved and the size minus one
+			data, err := readChunkHead(reader, length, 16)
+			if err != nil {
+				return nil, err
+			}
+			if anim != nil {
+				if anim.FrameCount == 0 {
+					x, y := uint24(data[0:3])*2, uint24(data[3:6])*2
+					anim.FirstFrame = image.Rect(x, y, x+uint24(data[6:9])+1, y+uint24(data[9:12])+1)
+				}
+				anim.FrameCount++
+				anim.Duration += float64(uint24(data[12:15])) / 1000
+			}
+		default:
+			if _, err := reader.Discard(length); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/fs"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// GetArchiveFormat returns the format of an expandable archive by the file name
+// Returns empty string if the file isn't a supported archive
+func GetArchiveFormat(filename string) string {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	default:
+		return ""
+	}
+}
+
+// walkArchive calls the callback for each regular file in the archive
+// The directories, symlinks and other special entries will be skipped
+func walkArchive(archivePath string, format string, cb func(name string, reader io.Reader) error) error {
+	switch format {
+	case "zip":
+		archive, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return fmt.Errorf("unable to open zip archive: %v", err)
+		}
+		defer archive.Close()
+
+		for _, entry := range archive.File {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			reader, err := entry.Open()
+			if err != nil {
+				return fmt.Errorf("unable to open archive entry %s: %v", entry.Name, err)
+			}
+			err = cb(entry.Name, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "tar", "tar.gz":
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return fmt.Errorf("unable to open tar archive: %v", err)
+		}
+		defer file.Close()
+
+		var in io.Reader = file
+		if format == "tar.gz" {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				return fmt.Errorf("unable to open gzip stream: %v", err)
+			}
+			defer gz.Close()
+			in = gz
+		}
+
+		archive := tar.NewReader(in)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("unable to read tar archive: %v", err)
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := cb(header.Name, archive); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported archive format: %s", format)
+	}
+}
+
+// ExpandArchiveToAttachments creates one attachment for each file in the archive.
+// The created attachments are still in the temporary storage, publish the analyze tasks after the transaction committed.
+// The entry count and the total uncompressed size are limited, the size is counted by the actual bytes read,
+// so the fake sizes in the archive headers won't help the zip bombs.
+func ExpandArchiveToAttachments(tx *gorm.DB, user *sec.UserInfo, pool models.AttachmentPool, archivePath string, format string, template models.Attachment) ([]models.Attachment, error) {
+	maxEntries := viper.GetInt("archives.max_entries")
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	maxSize := viper.GetInt64("archives.max_size")
+	if maxSize <= 0 {
+		maxSize = 1 << 30
+	}
+
+	destMap := viper.GetStringMapString("destinations.0")
+
+	var totalSize int64
+	var attachments []models.Attachment
+
+	cleanup := func() {
+		for _, item := range attachments {
+			_ = os.Remove(filepath.Join(destMap["path"], item.Uuid))
+		}
+	}
+
+	err := walkArchive(archivePath, format, func(name string, reader io.Reader) error {
+		name = filepath.ToSlash(name)
+		if path.IsAbs(name) || strings.HasPrefix(name, "../") || strings.Contains(name, "/../") || strings.HasSuffix(name, "/..") || name == ".." {
+			return fmt.Errorf("archive entry %s is trying to escape from the archive", name)
+		}
+		name = path.Clean(name)
+		if strings.HasPrefix(path.Base(name), ".") || strings.HasPrefix(name, "__MACOSX/") {
+			// Skip the hidden files and the resource forks
+			return nil
+		}
+
+		if len(attachments) >= maxEntries {
+			return fmt.Errorf("archive contains too many files, the limit is %d", maxEntries)
+		}
+
+		attachment := template
+		attachment.Uuid = uuid.NewString()
+		attachment.Rid = RandString(16)
+		attachment.Name = path.Base(name)
+		attachment.AccountID = user.ID
+		attachment.Pool = &pool
+		attachment.PoolID = &pool.ID
+		attachment.Destination = models.AttachmentDstTemporary
+
+		dst := filepath.Join(destMap["path"], attachment.Uuid)
+		out, err := os.Create(dst)
+		if err != nil {
+			return fmt.Errorf("unable to create file: %v", err)
+		}
+		// Add it into the list first to make sure it will be cleaned up
+		attachments = append(attachments, attachment)
+
+		remaining := maxSize - totalSize
+		written, err := io.Copy(out, io.LimitReader(reader, remaining+1))
+		out.Close()
+		if err != nil {
+			return fmt.Errorf("unable to extract archive entry %s: %v", name, err)
+		} else if written > remaining {
+			return fmt.Errorf("archive is too large after uncompressed, the limit is %d bytes", maxSize)
+		}
+		totalSize += written
+		attachment.Size = written
+
+		if !user.HasPermNode("CreateAttachments", attachment.Size) {
+			return fmt.Errorf("you are not permitted to create attachments like %s this large", name)
+		} else if pool.Config.Data().MaxFileSize != nil && attachment.Size > *pool.Config.Data().MaxFileSize {
+			return fmt.Errorf("attachment pool %s doesn't allow file larger than %d", pool.Alias, *pool.Config.Data().MaxFileSize)
+		} else if err := CheckAttachmentQuotaWithCount(user.ID, pool, totalSize, int64(len(attachments))); err != nil {
+			// The records created in this transaction aren't counted yet, so check with the total size and count
+			return err
+		}
+
+		attachment.MimeType = ""
+		if err := VerifyAttachmentContent(&attachment); err != nil {
+			return fmt.Errorf("archive entry %s was rejected: %v", name, err)
+		}
+
+		if err := tx.Save(&attachment).Error; err != nil {
+			return fmt.Errorf("failed to save attachment record: %v", err)
+		}
+		attachments[len(attachments)-1] = attachment
+
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+type archiveManifestEntry struct {
+	Name     string         `json:"name"`
+	Rid      string         `json:"rid"`
+	MimeType string         `json:"mimetype"`
+	Size     int64          `json:"size"`
+	Alt      string         `json:"alt"`
+	Metadata map[string]any `json:"metadata"`
+	Usermeta map[string]any `json:"usermeta"`
+}
+
+// WriteAttachmentsArchive streams the attachments as a zip archive into the writer.
+// Each entry is read from its destination directly, nothing will be staged on the disk.
+// The duplicated names will be renamed like "name (1).ext", and a manifest.json will be appended if required.
+func WriteAttachmentsArchive(out io.Writer, attachments []models.Attachment, withManifest bool) error {
+	archive := zip.NewWriter(out)
+	defer archive.Close()
+
+	usedNames := make(map[string]int)
+	if withManifest {
+		// Reserve the name of the manifest, the attachment named as it will be renamed
+		usedNames["manifest.json"] = 1
+	}
+	var manifest []archiveManifestEntry
+
+	for _, attachment := range attachments {
+		name := path.Base(filepath.ToSlash(attachment.Name))
+		if len(name) == 0 || name == "." || name == "/" {
+			name = attachment.Rid
+		}
+		if count, ok := usedNames[strings.ToLower(name)]; ok {
+			ext := path.Ext(name)
+			candidate := name
+			for {
+				candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), count, ext)
+				if _, ok := usedNames[strings.ToLower(candidate)]; !ok {
+					break
+				}
+				count++
+			}
+			usedNames[strings.ToLower(name)] = count + 1
+			name = candidate
+		}
+		usedNames[strings.ToLower(name)] = 1
+
+		reader, err := fs.OpenFileReader(attachment, attachment.Destination)
+		if err != nil {
+			return fmt.Errorf("unable to open attachment %s: %v", attachment.Rid, err)
+		}
+
+		// The media files are already compressed, deflate them again just wasting the cpu time
+		method := zip.Deflate
+		if lo.Contains(mediaMimeKinds, strings.SplitN(attachment.MimeType, "/", 2)[0]) {
+			method = zip.Store
+		}
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   method,
+			Modified: attachment.CreatedAt,
+		})
+		if err != nil {
+			reader.Close()
+			return fmt.Errorf("unable to create archive entry: %v", err)
+		}
+		_, err = io.Copy(entry, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("unable to write attachment %s into archive: %v", attachment.Rid, err)
+		}
+
+		manifest = append(manifest, archiveManifestEntry{
+			Name:     name,
+			Rid:      attachment.Rid,
+			MimeType: attachment.MimeType,
+			Size:     attachment.Size,
+			Alt:      attachment.Alternative,
+			Metadata: attachment.Metadata,
+			Usermeta: attachment.Usermeta,
+		})
+	}
+
+	if withManifest {
+		entry, err := archive.Create("manifest.json")
+		if err != nil {
+			return fmt.Errorf("unable to create archive manifest: %v", err)
+		}
+		if err := jsoniter.NewEncoder(entry).Encode(manifest); err != nil {
+			return fmt.Errorf("unable to write archive manifest: %v", err)
+		}
+	}
+
+	return archive.Close()
+}
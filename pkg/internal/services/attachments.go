@@ -3,10 +3,7 @@ package services
 import (
 	"context"
 	"fmt"
-	"mime"
 	"mime/multipart"
-	"net/http"
-	"path/filepath"
 	"time"
 
 	"git.solsynth.dev/hypernet/nexus/pkg/nex/sec"
@@ -21,6 +18,7 @@ import (
 
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
 	"github.com/google/uuid"
+	"github.com/samber/lo"
 	"gorm.io/gorm"
 )
 
@@ -81,7 +79,7 @@ func GetAttachmentByHash(hash string) (models.Attachment, error) {
 	var attachment models.Attachment
 	if err := database.C.Where(models.Attachment{
 		HashCode: hash,
-	}).Preload("Pool").First(&attachment).Error; err != nil {
+	}).Where("is_quarantined = ?", false).Preload("Pool").First(&attachment).Error; err != nil {
 		return attachment, err
 	}
 	return attachment, nil
@@ -123,27 +121,17 @@ func NewAttachmentMetadata(tx *gorm.DB, user *sec.UserInfo, file *multipart.File
 	attachment.Name = file.Filename
 	attachment.AccountID = user.ID
 
-	// If the user didn't provide file mimetype manually, we have to detect it
-	if len(attachment.MimeType) == 0 {
-		if ext := filepath.Ext(attachment.Name); len(ext) > 0 {
-			// Detect mimetype by file extensions
-			attachment.MimeType = mime.TypeByExtension(ext)
-		} else {
-			// Detect mimetype by file header
-			// This method as a fallback method, because this isn't pretty accurate
-			header, err := file.Open()
-			if err != nil {
-				return attachment, fmt.Errorf("failed to read file header: %v", err)
-			}
-			defer header.Close()
+	// Detect the mimetype by the file header, the mimetype provided by user only use to verify
+	header, err := file.Open()
+	if err != nil {
+		return attachment, fmt.Errorf("failed to read file header: %v", err)
+	}
+	defer header.Close()
 
-			fileHeader := make([]byte, 512)
-			_, err = header.Read(fileHeader)
-			if err != nil {
-				return attachment, err
-			}
-			attachment.MimeType = http.DetectContentType(fileHeader)
-		}
+	if mimetype, err := ResolveAttachmentMimeType(attachment.Pool, attachment.Name, attachment.MimeType, header); err != nil {
+		return attachment, err
+	} else {
+		attachment.MimeType = mimetype
 	}
 
 	if err := tx.Save(&attachment).Error; err != nil {
@@ -172,16 +160,36 @@ func TryLinkAttachment(tx *gorm.DB, og models.Attachment, hash string) (bool, er
 		Destination: prev.Destination,
 		IsSelfRef:   og.AccountID == prev.AccountID,
 	}).Error; err != nil {
-		tx.Rollback()
 		return true, err
 	} else if err = tx.Model(&prev).Update("ref_count", prev.RefCount+1).Error; err != nil {
-		tx.Rollback()
 		return true, err
 	}
 
 	return true, nil
 }
 
+// SetAttachmentStatus moves the attachment to the status, the reason is only for the failed status
+// The update only applies when the status in the database is still the one we have seen, to avoid overwriting others' changes
+func SetAttachmentStatus(tx *gorm.DB, file *models.Attachment, status string, reason ...string) error {
+	if !file.CanTransitTo(status) {
+		return fmt.Errorf("attachment status cannot be changed from %s to %s", file.Status, status)
+	}
+
+	result := tx.Model(file).Where("status = ?", file.Status).Updates(map[string]any{
+		"status":         status,
+		"failure_reason": lo.FirstOr(reason, ""),
+	})
+	if result.Error != nil {
+		return fmt.Errorf("unable to update attachment status: %v", result.Error)
+	} else if result.RowsAffected == 0 {
+		return fmt.Errorf("attachment status was changed by others, expected %s", file.Status)
+	}
+
+	file.Status = status
+	file.FailureReason = lo.FirstOr(reason, "")
+	return nil
+}
+
 func UpdateAttachment(item models.Attachment) (models.Attachment, error) {
 	if err := database.C.Save(&item).Error; err != nil {
 		return item, err
@@ -190,51 +198,80 @@ func UpdateAttachment(item models.Attachment) (models.Attachment, error) {
 	return item, nil
 }
 
-func DeleteAttachment(item models.Attachment, txs ...*gorm.DB) error {
-	dat := item
+// DeleteAttachment deletes the attachment with its thumbnail, compressed version and the derived ones
+// The files, the cache and the events are handled after the transaction committed, nothing will be touched if it failed
+func DeleteAttachment(item models.Attachment) error {
+	var deleted []models.Attachment
 
-	var tx *gorm.DB
-	if len(txs) == 0 {
-		tx = database.C.Begin()
-	} else {
-		tx = txs[0]
+	tx := database.C.Begin()
+	if err := deleteAttachmentInTx(tx, item, &deleted); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("unable to delete attachment: %v", err)
 	}
 
+	cacheManager := cache.New[any](localCache.S)
+	marshal := marshaler.New(cacheManager)
+	contx := context.Background()
+	for _, dat := range deleted {
+		_ = marshal.Delete(contx, GetAttachmentCacheKey(dat.Rid))
+
+		PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventDeleted, dat))
+
+		if dat.RefCount == 0 {
+			go fs.DeleteFile(dat)
+		}
+	}
+
+	return nil
+}
+
+// deleteAttachmentInTx deletes the records of the attachment and its children, the deleted ones are collected into the list
+func deleteAttachmentInTx(tx *gorm.DB, item models.Attachment, deleted *[]models.Attachment) error {
 	if item.RefID != nil {
 		var refTarget models.Attachment
-		if err := database.C.Where("id = ?", *item.RefID).First(&refTarget).Error; err == nil {
+		if err := tx.Where("id = ?", *item.RefID).First(&refTarget).Error; err == nil {
 			refTarget.RefCount--
 			if err := tx.Save(&refTarget).Error; err != nil {
-				tx.Rollback()
 				return fmt.Errorf("unable to update ref count: %v", err)
 			}
 		}
 	}
 	if item.Thumbnail != nil {
-		if err := DeleteAttachment(*item.Thumbnail, tx); err != nil {
+		if err := deleteAttachmentInTx(tx, *item.Thumbnail, deleted); err != nil {
 			return err
 		}
 	}
 	if item.Compressed != nil {
-		if err := DeleteAttachment(*item.Compressed, tx); err != nil {
+		if err := deleteAttachmentInTx(tx, *item.Compressed, deleted); err != nil {
 			return err
 		}
 	}
-	if err := database.C.Delete(&item).Error; err != nil {
-		tx.Rollback()
-		return err
-	} else {
-		cacheManager := cache.New[any](localCache.S)
-		marshal := marshaler.New(cacheManager)
-		contx := context.Background()
-		_ = marshal.Delete(contx, GetAttachmentCacheKey(item.Rid))
-	}
 
-	tx.Commit()
+	// The derived attachments cannot live without the original one
+	var children []models.Attachment
+	if err := tx.Where("parent_id = ?", item.ID).Find(&children).Error; err == nil {
+		for _, child := range children {
+			if (item.Thumbnail != nil && child.ID == item.Thumbnail.ID) || (item.Compressed != nil && child.ID == item.Compressed.ID) {
+				continue
+			}
+			if err := deleteAttachmentInTx(tx, child, deleted); err != nil {
+				return err
+			}
+		}
+	}
 
-	if dat.RefCount == 0 {
-		go fs.DeleteFile(dat)
+	// Every status can move to deleted, skip the check since the item may come from the cache
+	if err := tx.Model(&item).Update("status", models.AttachmentStatusDeleted).Error; err != nil {
+		return fmt.Errorf("unable to update attachment status: %v", err)
+	}
+	// Delete in the same transaction, the row is locked by the status update above
+	if err := tx.Delete(&item).Error; err != nil {
+		return err
 	}
 
+	*deleted = append(*deleted, item)
 	return nil
 }
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// The image will be scaled down before encoding, the hash only keeps the low frequencies anyway
+const blurHashSampleSize = 64
+
+// encodeBlurHash computes the BlurHash of the image, see https://github.com/woltapp/blurhash
+// The components follow the orientation of the image, 4x3 for the landscape ones and 3x4 for the portrait ones
+func encodeBlurHash(im image.Image) (string, error) {
+	bounds := im.Bounds()
+	if bounds.Dx() <= 0 || bounds.Dy() <= 0 {
+		return "", fmt.Errorf("image is empty")
+	}
+
+	xComp, yComp := 4, 3
+	if bounds.Dy() > bounds.Dx() {
+		xComp, yComp = 3, 4
+	}
+
+	width := min(bounds.Dx(), blurHashSampleSize)
+	height := min(bounds.Dy(), blurHashSampleSize)
+	if bounds.Dx() >= bounds.Dy() {
+		height = max(1, bounds.Dy()*width/bounds.Dx())
+	} else {
+		width = max(1, bounds.Dx()*height/bounds.Dy())
+	}
+	sample := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(sample, sample.Bounds(), im, bounds, draw.Src, nil)
+
+	// Convert to the linear colors once, they will be visited for every component
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := sample.PixOffset(x, y)
+			linear[y*width+x] = [3]float64{
+				sRGBToLinear(sample.Pix[offset]),
+				sRGBToLinear(sample.Pix[offset+1]),
+				sRGBToLinear(sample.Pix[offset+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			// The DC component is normalized by 1, the AC ones by 2
+			normalization := 2.0
+			if i == 0 && j == 0 {
+				normalization = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			scale := normalization / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComp-1)+(yComp-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, item := range ac {
+			actualMax = max(actualMax, math.Abs(item[0]), math.Abs(item[1]), math.Abs(item[2]))
+		}
+		quantisedMax := int(max(0, min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83((linearToSRGB(dc[0])<<16)+(linearToSRGB(dc[1])<<8)+linearToSRGB(dc[2]), 4))
+	for _, item := range ac {
+		quantise := func(val float64) int {
+			return int(max(0, min(18, math.Floor(signPow(val/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(item[0])*19*19+quantise(item[1])*19+quantise(item[2]), 2))
+	}
+
+	return hash.String(), nil
+}
+
+func sRGBToLinear(val uint8) float64 {
+	v := float64(val) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(val float64) int {
+	v := max(0, min(1, val))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(val, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(val), exp), val)
+}
+
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		out[i-1] = blurHashCharacters[digit]
+	}
+	return string(out)
+}
@@ -117,6 +117,13 @@ func ActivateBoost(boost models.AttachmentBoost) error {
 
 	log.Info().Any("boost", boost).Msg("Boost was activated successfully.")
 	database.C.Model(&boost).Update("status", models.BoostStatusActive)
+
+	event := NewAttachmentEvent(AttachmentEventBoostActivated, boost.Attachment, map[string]any{
+		"boost_id":    boost.ID,
+		"destination": boost.Destination,
+	})
+	event.AccountID = boost.AccountID
+	PublishAttachmentEvent(event)
 	return nil
 }
 
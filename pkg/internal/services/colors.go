@@ -0,0 +1,122 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/image/draw"
+)
+
+const (
+	paletteSampleSize = 64
+	paletteSize       = 5
+	paletteIterations = 10
+)
+
+// extractPalette clusters the pixels with k-means and returns the colors from the most to the least used
+// The transparent pixels are ignored, nothing will be returned for the fully transparent images
+func extractPalette(im image.Image) []string {
+	bounds := im.Bounds()
+	width, height := min(bounds.Dx(), paletteSampleSize), min(bounds.Dy(), paletteSampleSize)
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	sample := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(sample, sample.Bounds(), im, bounds, draw.Src, nil)
+
+	var pixels [][3]float64
+	for idx := 0; idx+3 < len(sample.Pix); idx += 4 {
+		if sample.Pix[idx+3] < 128 {
+			continue
+		}
+		pixels = append(pixels, [3]float64{float64(sample.Pix[idx]), float64(sample.Pix[idx+1]), float64(sample.Pix[idx+2])})
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	// Pick the initial centers from the pixels sorted by the brightness, keep the result stable for the same image
+	sorted := append([][3]float64{}, pixels...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0]+sorted[i][1]+sorted[i][2] < sorted[j][0]+sorted[j][1]+sorted[j][2]
+	})
+	k := min(paletteSize, len(pixels))
+	centers := make([][3]float64, k)
+	for idx := range centers {
+		centers[idx] = sorted[(2*idx+1)*len(sorted)/(2*k)]
+	}
+
+	counts := make([]int, k)
+	for iter := 0; iter < paletteIterations; iter++ {
+		sums := make([][3]float64, k)
+		counts = make([]int, k)
+		for _, pixel := range pixels {
+			nearest, best := 0, -1.0
+			for idx, center := range centers {
+				dr, dg, db := pixel[0]-center[0], pixel[1]-center[1], pixel[2]-center[2]
+				if dist := dr*dr + dg*dg + db*db; best < 0 || dist < best {
+					nearest, best = idx, dist
+				}
+			}
+			sums[nearest][0] += pixel[0]
+			sums[nearest][1] += pixel[1]
+			sums[nearest][2] += pixel[2]
+			counts[nearest]++
+		}
+
+		changed := false
+		for idx := range centers {
+			if counts[idx] == 0 {
+				continue
+			}
+			next := [3]float64{
+				sums[idx][0] / float64(counts[idx]),
+				sums[idx][1] / float64(counts[idx]),
+				sums[idx][2] / float64(counts[idx]),
+			}
+			if next != centers[idx] {
+				centers[idx], changed = next, true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	order := make([]int, k)
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+
+	var palette []string
+	for _, idx := range order {
+		if counts[idx] == 0 {
+			continue
+		}
+		color := fmt.Sprintf("#%02x%02x%02x", int(centers[idx][0]+0.5), int(centers[idx][1]+0.5), int(centers[idx][2]+0.5))
+		if !lo.Contains(palette, color) {
+			palette = append(palette, color)
+		}
+	}
+	return palette
+}
+
+// ParseHexColor parses the color like #ff8800 or ff8800 into the packed 0xRRGGBB integer
+func ParseHexColor(val string) (int, error) {
+	val = strings.TrimPrefix(strings.TrimSpace(val), "#")
+	if len(val) != 6 {
+		return 0, fmt.Errorf("color must be in the format of #rrggbb")
+	}
+	color, err := strconv.ParseUint(val, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("color must be in the format of #rrggbb")
+	}
+	return int(color), nil
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+	"path/filepath"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/barasher/go-exiftool"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// The formats cannot be decoded in go, they will be converted into png by heif-convert first
+var externalImageMimeTypes = []string{"image/heic", "image/heif", "image/avif"}
+
+func isExternalImage(mimetype string) bool {
+	return lo.ContainsBy(externalImageMimeTypes, func(item string) bool {
+		return matchMimeType(item, mimetype)
+	})
+}
+
+// getMaxImagePixels returns the max pixels of the images will be decoded, the larger ones are treated as the decompression bombs
+func getMaxImagePixels(pool *models.AttachmentPool) int64 {
+	if pool != nil && pool.Config.Data().MaxImagePixels != nil {
+		return *pool.Config.Data().MaxImagePixels
+	}
+	if val := viper.GetInt64("analyzers.image.max_pixels"); val > 0 {
+		return val
+	}
+	return 100_000_000
+}
+
+// probeImageSize reads the size of the image from its header without decoding the pixels
+func probeImageSize(path string, mimetype string) (int, int, error) {
+	if isExternalImage(mimetype) {
+		et, err := exiftool.NewExiftool()
+		if err != nil {
+			return 0, 0, fmt.Errorf("unable to start exiftool: %v", err)
+		}
+		defer et.Close()
+
+		data := et.ExtractMetadata(path)
+		if len(data) == 0 || data[0].Err != nil {
+			return 0, 0, fmt.Errorf("unable to read image header")
+		}
+		width, errW := data[0].GetInt("ImageWidth")
+		height, errH := data[0].GetInt("ImageHeight")
+		if errW != nil || errH != nil {
+			return 0, 0, fmt.Errorf("unable to read image size from header")
+		}
+		return int(width), int(height), nil
+	}
+
+	reader, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to open file: %v", err)
+	}
+	defer reader.Close()
+
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to read image header: %v", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// contextReader fails the reads after the context is done
+// The decoders read the file in small pieces, so they stop soon after the analyzer timed out
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (v contextReader) Read(p []byte) (int, error) {
+	if err := v.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return v.reader.Read(p)
+}
+
+// decodeImageFile decodes the image after checking its size in the header, the pixels are turned upright by the EXIF orientation
+// The external formats are converted in the work dir, it will be the dir of the file if not provided
+// The animated images only have their first frame decoded
+func decodeImageFile(ctx context.Context, file models.Attachment, path string, workDir ...string) (image.Image, error) {
+	orientation := readImageOrientation(ctx, path, file.MimeType)
+	width, height, err := probeImageSize(path, file.MimeType)
+	if err != nil {
+		return nil, err
+	}
+	if limit := getMaxImagePixels(file.Pool); int64(width)*int64(height) > limit {
+		return nil, fmt.Errorf("image has %dx%d pixels, more than the limit %d", width, height, limit)
+	}
+
+	// Convert the formats cannot be decoded in go into the decodable ones first
+	var tool, ext string
+	var args []string
+	var anim *imageAnimation
+	if isExternalImage(file.MimeType) {
+		tool, ext, args = "heif-convert", ".png", []string{path}
+	} else if matchMimeType("image/webp", file.MimeType) {
+		if anim, _ = probeImageAnimation(path, file.MimeType); anim != nil {
+			// Only the first frame of the animated WebP will be decoded
+			tool, ext, args = "webpmux", ".webp", []string{"-get", "frame", "1", path, "-o"}
+		}
+	}
+	if len(tool) > 0 && !isToolAvailable(tool) {
+		return nil, fmt.Errorf("unable to decode %s image, %s is not installed", file.MimeType, tool)
+	} else if len(tool) > 0 {
+		dir, err := os.MkdirTemp(lo.FirstOr(workDir, filepath.Dir(path)), ".convert-*")
+		if err != nil {
+			return nil, fmt.Errorf("unable to create work dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		converted := filepath.Join(dir, "image"+ext)
+		if _, err := runToolCommand(ctx, tool, append(args, converted)...); err != nil {
+			return nil, fmt.Errorf("unable to convert image: %v", err)
+		}
+		path = converted
+	}
+
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %v", err)
+	}
+	defer reader.Close()
+
+	// Check the size again, the one read by exiftool may be different from the converted one
+	if config, _, err := image.DecodeConfig(contextReader{ctx, reader}); err != nil {
+		return nil, fmt.Errorf("unable to read image header: %v", err)
+	} else if int64(config.Width)*int64(config.Height) > getMaxImagePixels(file.Pool) {
+		return nil, fmt.Errorf("image has %dx%d pixels, more than the limit", config.Width, config.Height)
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("unable to read file: %v", err)
+	}
+
+	im, _, err := image.Decode(contextReader{ctx, reader})
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode file as an image: %v", err)
+	}
+	if anim != nil && !anim.Canvas.Empty() && !anim.FirstFrame.Empty() && im.Bounds().Size() != anim.Canvas.Size() {
+		// The frame extracted by webpmux only covers its own rectangle, put it back onto the canvas
+		canvas := image.NewNRGBA(anim.Canvas)
+		draw.Draw(canvas, anim.FirstFrame.Intersect(anim.Canvas), im, im.Bounds().Min, draw.Src)
+		im = canvas
+	}
+	return applyImageOrientation(im, orientation), nil
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// AttachmentDerivedFile is a file generated from an attachment by the analyzers, like the cover art or the thumbnails
+type AttachmentDerivedFile struct {
+	Path     string
+	Name     string
+	MimeType string
+	Type     uint           // One of the models.AttachmentType*
+	Metadata map[string]any // The analyzed metadata of the derived file itself will be merged into it
+	Rid      string         // Leave it empty to generate one, set it when other derived files need to refer to this one
+
+	IsThumbnail  bool // Use it as the thumbnail of the parent if the parent doesn't have one
+	IsCompressed bool // Use it as the compressed version of the parent if the parent doesn't have one
+}
+
+// SaveDerivedAttachments moves the derived files into the temporary storage and creates the child attachments.
+// The children are still need to be analyzed and transferred, publish the analyze tasks after the transaction committed.
+// The moved files have no record if the transaction isn't committed, remove them by discardDerivedAttachments.
+// The children moved before an error are returned with the error, so they can be removed as well.
+func SaveDerivedAttachments(tx *gorm.DB, parent *models.Attachment, files []AttachmentDerivedFile) ([]models.Attachment, error) {
+	destMap := viper.GetStringMapString("destinations.0")
+
+	var children []models.Attachment
+	for _, file := range files {
+		stat, err := os.Stat(file.Path)
+		if err != nil {
+			return children, fmt.Errorf("unable to read derived file %s: %v", file.Name, err)
+		}
+
+		rid := file.Rid
+		if len(rid) == 0 {
+			rid = RandString(16)
+		}
+
+		child := models.Attachment{
+			Rid:         rid,
+			Uuid:        uuid.NewString(),
+			Size:        stat.Size(),
+			Name:        file.Name,
+			MimeType:    file.MimeType,
+			Type:        file.Type,
+			Destination: models.AttachmentDstTemporary,
+			Metadata:    file.Metadata,
+			ParentID:    &parent.ID,
+			PoolID:      parent.PoolID,
+			AccountID:   parent.AccountID,
+		}
+		if err := os.Rename(file.Path, filepath.Join(destMap["path"], child.Uuid)); err != nil {
+			return children, fmt.Errorf("unable to move derived file %s: %v", file.Name, err)
+		}
+		if err := tx.Save(&child).Error; err != nil {
+			_ = os.Remove(filepath.Join(destMap["path"], child.Uuid))
+			return children, fmt.Errorf("unable to save derived attachment: %v", err)
+		}
+
+		if file.IsThumbnail && parent.ThumbnailID == nil {
+			parent.ThumbnailID = &child.ID
+		}
+		if file.IsCompressed && parent.CompressedID == nil {
+			parent.CompressedID = &child.ID
+		}
+		children = append(children, child)
+	}
+
+	return children, nil
+}
+
+// discardDerivedAttachments removes the files moved by SaveDerivedAttachments after the transaction was rolled back
+func discardDerivedAttachments(children []models.Attachment) {
+	destMap := viper.GetStringMapString("destinations.0")
+	for _, child := range children {
+		_ = os.Remove(filepath.Join(destMap["path"], child.Uuid))
+	}
+}
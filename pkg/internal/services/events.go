@@ -0,0 +1,123 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/fs"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/samber/lo"
+)
+
+const (
+	AttachmentEventChunkReceived = "chunk_received"
+	AttachmentEventMerged        = "merged"
+	AttachmentEventAnalyzing     = "analyzing"
+	AttachmentEventAnalyzed      = "analyzed"
+	AttachmentEventTransferring  = "transferring"
+	AttachmentEventReady         = "ready"
+	AttachmentEventFailed        = "failed"
+
+	AttachmentEventCreated          = "created"
+	AttachmentEventDeleted          = "deleted"
+	AttachmentEventBoostActivated   = "boost_activated"
+	AttachmentEventLifecycleCleaned = "lifecycle_cleaned"
+)
+
+// These events will be delivered to the webhooks, the others are too noisy for them
+var webhookAttachmentEvents = []string{
+	AttachmentEventCreated,
+	AttachmentEventAnalyzed,
+	AttachmentEventReady,
+	AttachmentEventDeleted,
+	AttachmentEventBoostActivated,
+	AttachmentEventLifecycleCleaned,
+}
+
+// AttachmentEvent is the lifecycle event of an attachment
+// For the events before the fragment merged, the rid is the rid of the fragment
+type AttachmentEvent struct {
+	Type         string         `json:"type"`
+	Rid          string         `json:"rid"`
+	AttachmentID uint           `json:"attachment_id"`
+	AccountID    uint           `json:"account_id"`
+	PoolID       *uint          `json:"pool_id"`
+	Data         map[string]any `json:"data,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+// NewAttachmentEvent creates an event of the attachment
+func NewAttachmentEvent(kind string, file models.Attachment, data ...map[string]any) AttachmentEvent {
+	event := AttachmentEvent{
+		Type:         kind,
+		Rid:          file.Rid,
+		AttachmentID: file.ID,
+		AccountID:    file.AccountID,
+		PoolID:       file.PoolID,
+	}
+	if len(data) > 0 {
+		event.Data = data[0]
+	}
+	return event
+}
+
+var (
+	attachmentEventSubscribers     = make(map[uint]map[chan AttachmentEvent]bool)
+	attachmentEventSubscribersLock sync.RWMutex
+)
+
+// SubscribeAttachmentEvents subscribes the events of the attachments owned by the account
+// Call the returned function to unsubscribe, the channel will be closed after that
+func SubscribeAttachmentEvents(accountId uint) (chan AttachmentEvent, func()) {
+	ch := make(chan AttachmentEvent, 32)
+
+	attachmentEventSubscribersLock.Lock()
+	if _, ok := attachmentEventSubscribers[accountId]; !ok {
+		attachmentEventSubscribers[accountId] = make(map[chan AttachmentEvent]bool)
+	}
+	attachmentEventSubscribers[accountId][ch] = true
+	attachmentEventSubscribersLock.Unlock()
+
+	return ch, func() {
+		attachmentEventSubscribersLock.Lock()
+		delete(attachmentEventSubscribers[accountId], ch)
+		if len(attachmentEventSubscribers[accountId]) == 0 {
+			delete(attachmentEventSubscribers, accountId)
+		}
+		attachmentEventSubscribersLock.Unlock()
+		close(ch)
+	}
+}
+
+// PublishAttachmentEvent sends the event to all subscribers of the account, the webhooks and the other services
+// The slow subscribers will miss the event instead of blocking the publisher
+func PublishAttachmentEvent(event AttachmentEvent) {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	if lo.Contains(webhookAttachmentEvents, event.Type) {
+		go DeliverAttachmentWebhooks(event)
+	}
+	if _, ok := nexusAttachmentEvents[event.Type]; ok {
+		go publishAttachmentNexusEvent(event)
+	}
+
+	attachmentEventSubscribersLock.RLock()
+	defer attachmentEventSubscribersLock.RUnlock()
+
+	for ch := range attachmentEventSubscribers[event.AccountID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func init() {
+	fs.OnLifecycleCleaned = func(attachments []models.Attachment) {
+		for _, attachment := range attachments {
+			PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventLifecycleCleaned, attachment))
+		}
+	}
+}
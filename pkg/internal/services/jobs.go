@@ -0,0 +1,363 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// jobSignal wakes up the idle workers when new jobs are enqueued
+// The workers will poll the database periodically anyway, so missing a signal is fine
+var jobSignal = make(chan struct{}, 1)
+
+// retryBackoff returns the delay before the next attempt
+// 10s, 20s, 40s, 80s... capped at one hour
+func retryBackoff(attempt int) time.Duration {
+	return min(time.Duration(1<<(attempt-1))*10*time.Second, time.Hour)
+}
+
+func getJobLease() time.Duration {
+	lease := viper.GetDuration("jobs.lease")
+	if lease <= 0 {
+		lease = 5 * time.Minute
+	}
+	return lease
+}
+
+// EnqueueJob creates a job in the queue, pass the transaction to enqueue it with other changes atomically
+func EnqueueJob(tx *gorm.DB, kind string, attachmentId *uint, payload map[string]any, priority int) (models.Job, error) {
+	maxAttempts := viper.GetInt("jobs.max_attempts")
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	job := models.Job{
+		Type:         kind,
+		Status:       models.JobStatusPending,
+		Priority:     priority,
+		Payload:      payload,
+		MaxAttempts:  maxAttempts,
+		RunAt:        time.Now(),
+		AttachmentID: attachmentId,
+	}
+	if err := tx.Save(&job).Error; err != nil {
+		return job, err
+	}
+
+	select {
+	case jobSignal <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+// PublishAnalyzeTask enqueues the analyze job of the attachment
+// The uploader wants the result as soon as possible can enqueue it with a higher priority
+func PublishAnalyzeTask(file models.Attachment, priority ...int) {
+	if _, err := EnqueueJob(database.C, models.JobTypeAnalyze, &file.ID, nil, lo.FirstOr(priority, models.JobPriorityBackground)); err != nil {
+		log.Error().Err(err).Uint("id", file.ID).Msg("Unable to enqueue file analyze task...")
+	}
+}
+
+// PublishTransferTask enqueues the job moving the attachment to another destination
+func PublishTransferTask(file models.Attachment, dst int, priority ...int) {
+	if _, err := EnqueueJob(database.C, models.JobTypeTransfer, &file.ID, map[string]any{
+		"destination": dst,
+	}, lo.FirstOr(priority, models.JobPriorityBackground)); err != nil {
+		log.Error().Err(err).Uint("id", file.ID).Msg("Unable to enqueue file transfer task...")
+	}
+}
+
+// claimJob picks the most important runnable job and leases it to the worker
+// The running jobs whose lease expired are treated as runnable, their worker probably crashed
+func claimJob(worker string) (*models.Job, error) {
+	now := time.Now()
+
+	var job models.Job
+	err := database.C.Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where(
+				"(status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?)",
+				models.JobStatusPending, now, models.JobStatusRunning, now,
+			).
+			Order("priority DESC, run_at ASC, id ASC").
+			First(&job).Error; err != nil {
+			return err
+		}
+
+		if job.Status == models.JobStatusRunning && job.Attempts >= job.MaxAttempts {
+			// The job keeps killing its workers, stop trying
+			job.Status = models.JobStatusDead
+			job.LastError = "lease expired on the last attempt"
+			job.LockedBy = nil
+			job.LockedUntil = nil
+			job.FinishedAt = &now
+			return tx.Save(&job).Error
+		}
+
+		job.Status = models.JobStatusRunning
+		job.Attempts++
+		job.LockedBy = &worker
+		job.LockedUntil = lo.ToPtr(now.Add(getJobLease()))
+		return tx.Save(&job).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Status == models.JobStatusDead {
+		onJobDead(job)
+		return nil, nil
+	}
+
+	return &job, nil
+}
+
+// StartConsumeJobs runs a worker consuming the job queue, it never returns
+func StartConsumeJobs(worker string) {
+	for {
+		job, err := claimJob(worker)
+		if err != nil {
+			if err != gorm.ErrRecordNotFound {
+				log.Error().Err(err).Str("worker", worker).Msg("Unable to claim job from the queue...")
+			}
+			select {
+			case <-jobSignal:
+			case <-time.After(time.Second):
+			}
+			continue
+		} else if job == nil {
+			continue
+		}
+
+		runJob(*job)
+	}
+}
+
+func runJob(job models.Job) {
+	start := time.Now()
+
+	// Renew the lease while the job is running, the long transfers can take longer than a lease
+	done := make(chan struct{})
+	go func() {
+		lease := getJobLease()
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				database.C.Model(&job).Where("locked_by = ?", *job.LockedBy).Update("locked_until", time.Now().Add(lease))
+			}
+		}
+	}()
+
+	err := handleJob(job)
+	close(done)
+
+	// Only update the job still held by this worker, it may be re-claimed by another one after the lease expired
+	held := database.C.Model(&job).Where("locked_by = ?", *job.LockedBy)
+
+	if err == nil {
+		log.Info().Dur("elapsed", time.Since(start)).Uint("job", job.ID).Str("type", job.Type).Msg("A job was completed.")
+		held.Updates(map[string]any{
+			"status":       models.JobStatusCompleted,
+			"last_error":   "",
+			"locked_by":    nil,
+			"locked_until": nil,
+			"finished_at":  time.Now(),
+		})
+		return
+	}
+
+	log.Error().Err(err).Uint("job", job.ID).Str("type", job.Type).Int("attempt", job.Attempts).Msg("A job failed...")
+
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = models.JobStatusDead
+		job.LastError = err.Error()
+		if tx := held.Updates(map[string]any{
+			"status":       models.JobStatusDead,
+			"last_error":   job.LastError,
+			"locked_by":    nil,
+			"locked_until": nil,
+			"finished_at":  time.Now(),
+		}); tx.Error == nil && tx.RowsAffected > 0 {
+			onJobDead(job)
+		}
+		return
+	}
+
+	held.Updates(map[string]any{
+		"status":       models.JobStatusPending,
+		"last_error":   err.Error(),
+		"locked_by":    nil,
+		"locked_until": nil,
+		"run_at":       time.Now().Add(retryBackoff(job.Attempts)),
+	})
+}
+
+func handleJob(job models.Job) error {
+	if job.Type == models.JobTypeWebhook {
+		return SendWebhookDelivery(cast.ToUint(job.Payload["delivery"]), job.Attempts)
+	}
+
+	if job.AttachmentID == nil {
+		return fmt.Errorf("job has no attachment")
+	}
+
+	var file models.Attachment
+	if err := database.C.Where("id = ?", *job.AttachmentID).Preload("Pool").First(&file).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			// The attachment was deleted, nothing to do anymore
+			return nil
+		}
+		return fmt.Errorf("unable to get attachment: %v", err)
+	}
+
+	switch job.Type {
+	case models.JobTypeAnalyze:
+		if file.Status != models.AttachmentStatusPending && file.Status != models.AttachmentStatusAnalyzing {
+			// Already processed by the previous attempt, or deleted
+			return nil
+		}
+		return AnalyzeAttachment(file, job.Priority)
+	case models.JobTypeTransfer:
+		dst := cast.ToInt(job.Payload["destination"])
+		if file.Status != models.AttachmentStatusTransferring || file.Destination == dst {
+			return nil
+		}
+		return TransferAttachment(file, dst)
+	case models.JobTypeTranscode:
+		if file.Status != models.AttachmentStatusReady {
+			return nil
+		}
+		return TranscodeAttachment(file)
+	case models.JobTypePlaceholder:
+		if file.Status != models.AttachmentStatusReady {
+			return nil
+		}
+		return ComputeAttachmentPlaceholder(file)
+	default:
+		return fmt.Errorf("unknown job type: %s", job.Type)
+	}
+}
+
+func onJobDead(job models.Job) {
+	log.Warn().Uint("job", job.ID).Str("type", job.Type).Str("error", job.LastError).Msg("A job was dead after all the attempts...")
+
+	if job.AttachmentID == nil || job.Type == models.JobTypeTranscode || job.Type == models.JobTypePlaceholder {
+		// The original file is still usable without the outputs of these jobs
+		return
+	}
+	var file models.Attachment
+	if err := database.C.Where("id = ?", *job.AttachmentID).First(&file).Error; err != nil {
+		return
+	}
+	if err := SetAttachmentStatus(database.C, &file, models.AttachmentStatusFailed, job.LastError); err != nil {
+		log.Warn().Err(err).Uint("id", file.ID).Msg("Unable to mark attachment as failed...")
+		return
+	}
+	PublishAttachmentEvent(NewAttachmentEvent(AttachmentEventFailed, file, map[string]any{"reason": job.LastError}))
+}
+
+func CountJobs(tx *gorm.DB) (int64, error) {
+	var count int64
+	if err := tx.Model(&models.Job{}).Count(&count).Error; err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+func ListJobs(tx *gorm.DB, take, offset int) ([]models.Job, error) {
+	var jobs []models.Job
+	if err := tx.Order("created_at DESC").Limit(take).Offset(offset).Find(&jobs).Error; err != nil {
+		return jobs, err
+	}
+	return jobs, nil
+}
+
+func GetJob(id uint) (models.Job, error) {
+	var job models.Job
+	if err := database.C.Where("id = ?", id).First(&job).Error; err != nil {
+		return job, err
+	}
+	return job, nil
+}
+
+// CountJobsByStatus returns the amount of the jobs in each status, for monitoring the queue
+func CountJobsByStatus() (map[string]int64, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	if err := database.C.
+		Model(&models.Job{}).
+		Select("status, COUNT(*) AS count").
+		Group("status").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		out[row.Status] = row.Count
+	}
+	return out, nil
+}
+
+// RetryJob puts a dead job back into the queue with its attempts reset
+// The failed attachment will be moved back to the status the job expected
+func RetryJob(job models.Job) (models.Job, error) {
+	if job.Status != models.JobStatusDead {
+		return job, fmt.Errorf("only dead jobs can be retried")
+	}
+
+	if job.AttachmentID != nil {
+		var file models.Attachment
+		if err := database.C.Where("id = ?", *job.AttachmentID).First(&file).Error; err == nil && file.Status == models.AttachmentStatusFailed {
+			status := lo.Ternary(job.Type == models.JobTypeTransfer, models.AttachmentStatusTransferring, models.AttachmentStatusPending)
+			if err := SetAttachmentStatus(database.C, &file, status); err != nil {
+				return job, err
+			}
+		}
+	}
+
+	job.Status = models.JobStatusPending
+	job.Attempts = 0
+	job.RunAt = time.Now()
+	job.FinishedAt = nil
+	if err := database.C.Save(&job).Error; err != nil {
+		return job, err
+	}
+
+	select {
+	case jobSignal <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+// DoJobQueueCleanup removes the completed jobs, the dead ones are kept for inspection
+func DoJobQueueCleanup() {
+	deadline := time.Now().Add(-24 * time.Hour)
+	tx := database.C.Unscoped().
+		Where("status = ? AND finished_at < ?", models.JobStatusCompleted, deadline).
+		Delete(&models.Job{})
+	if tx.Error != nil {
+		log.Error().Err(tx.Error).Msg("An error occurred when cleaning up the job queue...")
+	} else {
+		log.Debug().Int64("affected", tx.RowsAffected).Msg("Clean up completed jobs accomplished.")
+	}
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+)
+
+// These types cannot tell what the file actually is, so we trust what the client said about it
+var genericMimeTypes = []string{"application/octet-stream", "text/plain"}
+
+var mediaMimeKinds = []string{"image", "video", "audio"}
+
+// isMimeTypeAccepted reports the Accept header lists the mimetype explicitly with a quality above zero
+// The wildcards like image/* are ignored, the browsers send them even if they cannot display the modern formats
+func isMimeTypeAccepted(accept string, mimetype string) bool {
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(entry, ";")
+		if !strings.EqualFold(strings.TrimSpace(mediaType), mimetype) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, val, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if quality, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err != nil || quality <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func matchMimeType(pattern string, mimetype string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	mimetype = strings.ToLower(strings.TrimSpace(strings.SplitN(mimetype, ";", 2)[0]))
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.SplitN(mimetype, "/", 2)[0] == strings.TrimSuffix(pattern, "/*")
+	}
+	return pattern == mimetype
+}
+
+func isGenericMimeType(mtype *mimetype.MIME) bool {
+	for _, item := range genericMimeTypes {
+		if mtype.Is(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAttachmentPoolPolicy checks the file name and the mimetype against the content type policy of the pool.
+// This one only depends on the information provided, use ResolveAttachmentMimeType to verify the file content.
+func CheckAttachmentPoolPolicy(pool *models.AttachmentPool, filename string, mimetype string) error {
+	if pool == nil {
+		return nil
+	}
+
+	config := pool.Config.Data()
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	if len(ext) > 0 && lo.ContainsBy(config.DeniedExtensions, func(item string) bool {
+		return strings.EqualFold(item, ext)
+	}) {
+		return fmt.Errorf("attachment pool %s doesn't allow %s files", pool.Alias, ext)
+	}
+	if len(config.AllowedExtensions) > 0 && !lo.ContainsBy(config.AllowedExtensions, func(item string) bool {
+		return strings.EqualFold(item, ext)
+	}) {
+		return fmt.Errorf("attachment pool %s only allow %s files", pool.Alias, strings.Join(config.AllowedExtensions, ", "))
+	}
+
+	if len(mimetype) == 0 {
+		return nil
+	}
+	if lo.ContainsBy(config.DeniedTypes, func(item string) bool {
+		return matchMimeType(item, mimetype)
+	}) {
+		return fmt.Errorf("attachment pool %s doesn't allow %s files", pool.Alias, mimetype)
+	}
+	if len(config.AllowedTypes) > 0 && !lo.ContainsBy(config.AllowedTypes, func(item string) bool {
+		return matchMimeType(item, mimetype)
+	}) {
+		return fmt.Errorf("attachment pool %s only allow %s files", pool.Alias, strings.Join(config.AllowedTypes, ", "))
+	}
+
+	return nil
+}
+
+// ResolveAttachmentMimeType detects the real mimetype of the file by the magic bytes in the file header.
+// The declared mimetype (provided by the client or guessed by the file extension) must agree with the detected one,
+// and the detected one must be allowed by the pool. Returns the mimetype that should be stored.
+func ResolveAttachmentMimeType(pool *models.AttachmentPool, filename string, declared string, reader io.Reader) (string, error) {
+	if len(declared) == 0 {
+		if ext := filepath.Ext(filename); len(ext) > 0 {
+			declared = mime.TypeByExtension(ext)
+		}
+	}
+
+	detected, err := mimetype.DetectReader(reader)
+	if err != nil {
+		return declared, fmt.Errorf("failed to read file header: %v", err)
+	}
+
+	result := detected.String()
+	if isGenericMimeType(detected) {
+		// Media files always have magic bytes, claim a unrecognizable file as media is not allowed
+		if len(declared) > 0 && lo.Contains(mediaMimeKinds, strings.SplitN(declared, "/", 2)[0]) {
+			return result, fmt.Errorf("file content doesn't match its type, declared as %s but the content is unrecognizable", declared)
+		} else if len(declared) > 0 {
+			result = declared
+		}
+	} else if len(declared) > 0 {
+		matched := false
+		for item := detected; item != nil; item = item.Parent() {
+			if item.Is(declared) {
+				matched = true
+				break
+			}
+		}
+		// Only the media files can differ in the subtype, like a png declared as jpeg
+		// The others must match exactly, otherwise an executable can be declared as a pdf since both are application
+		declaredKind := strings.ToLower(strings.SplitN(declared, "/", 2)[0])
+		detectedKind := strings.ToLower(strings.SplitN(detected.String(), "/", 2)[0])
+		if !matched && (declaredKind != detectedKind || !lo.Contains(mediaMimeKinds, detectedKind)) {
+			return result, fmt.Errorf("file content doesn't match its type, declared as %s but detected as %s", declared, detected.String())
+		}
+	}
+
+	if err := CheckAttachmentPoolPolicy(pool, filename, result); err != nil {
+		return result, err
+	}
+
+	if pool != nil {
+		// Check the detected type with all its parents against the deny list and the real extension
+		// So the disguised files like an executable renamed to .png will be caught
+		// The root type (application/octet-stream) is skipped, otherwise deny application/* will block everything
+		config := pool.Config.Data()
+		for item := detected; item != nil && (item == detected || item.Parent() != nil); item = item.Parent() {
+			if lo.ContainsBy(config.DeniedTypes, func(pattern string) bool {
+				return matchMimeType(pattern, item.String())
+			}) {
+				return result, fmt.Errorf("attachment pool %s doesn't allow %s files", pool.Alias, item.String())
+			}
+		}
+		if ext := detected.Extension(); len(ext) > 0 && lo.ContainsBy(config.DeniedExtensions, func(item string) bool {
+			return strings.EqualFold(item, ext)
+		}) {
+			return result, fmt.Errorf("attachment pool %s doesn't allow %s files", pool.Alias, ext)
+		}
+	}
+
+	return result, nil
+}
+
+// VerifyAttachmentContent resolves the mimetype of a file that already in the temporary storage
+// Use this one when the file isn't uploaded in a single request (like the multipart uploads)
+func VerifyAttachmentContent(file *models.Attachment) error {
+	destMap := viper.GetStringMapString("destinations.0")
+	destPath := filepath.Join(destMap["path"], file.Uuid)
+
+	reader, err := os.Open(destPath)
+	if err != nil {
+		return fmt.Errorf("unable to open file: %v", err)
+	}
+	defer reader.Close()
+
+	mimetype, err := ResolveAttachmentMimeType(file.Pool, file.Name, file.MimeType, reader)
+	if err != nil {
+		return err
+	}
+
+	file.MimeType = mimetype
+	return nil
+}
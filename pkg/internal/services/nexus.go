@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"git.solsynth.dev/hypernet/nexus/pkg/nex"
+	"git.solsynth.dev/hypernet/nexus/pkg/proto"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/gap"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// The events published to other services via Nexus
+// The payload schema is documented in the README, keep them stable
+const (
+	NexusEventAttachmentCreated  = "attachments.created"
+	NexusEventAttachmentReady    = "attachments.ready"
+	NexusEventAttachmentDeleted  = "attachments.deleted"
+	NexusEventStickerPackUpdated = "stickers.pack.updated"
+)
+
+var nexusAttachmentEvents = map[string]string{
+	AttachmentEventCreated: NexusEventAttachmentCreated,
+	AttachmentEventReady:   NexusEventAttachmentReady,
+	AttachmentEventDeleted: NexusEventAttachmentDeleted,
+}
+
+// PublishNexusEvent broadcasts the event to the other services through Nexus
+// Failing to publish will only be logged, the other services should treat these events as hints
+func PublishNexusEvent(event string, data map[string]any) {
+	if gap.Nx == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := proto.NewDirectoryServiceClient(gap.Nx.GetNexusGrpcConn()).BroadcastEvent(ctx, &proto.EventInfo{
+		Event: event,
+		Data:  nex.EncodeMap(data),
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("event", event).Msg("Unable to publish event to nexus...")
+	}
+}
+
+func publishAttachmentNexusEvent(event AttachmentEvent) {
+	name, ok := nexusAttachmentEvents[event.Type]
+	if !ok {
+		return
+	}
+
+	PublishNexusEvent(name, map[string]any{
+		"id":         event.AttachmentID,
+		"rid":        event.Rid,
+		"account_id": event.AccountID,
+		"pool_id":    event.PoolID,
+		"timestamp":  event.CreatedAt.Unix(),
+	})
+}
+
+// PublishStickerPackUpdated tells the other services the stickers in the pack were changed
+func PublishStickerPackUpdated(pack models.StickerPack, deleted bool) {
+	go PublishNexusEvent(NexusEventStickerPackUpdated, map[string]any{
+		"id":         pack.ID,
+		"prefix":     pack.Prefix,
+		"account_id": pack.AccountID,
+		"deleted":    deleted,
+		"timestamp":  time.Now().Unix(),
+	})
+}
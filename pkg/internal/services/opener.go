@@ -68,6 +68,14 @@ func OpenAttachmentByRID(rid string, region ...string) (url string, mimetype str
 		}
 	}
 
+	if result.Attachment.IsQuarantined {
+		err = fmt.Errorf("attachment was quarantined")
+		return
+	} else if IsAttachmentPrivacyFailed(result.Attachment) {
+		err = fmt.Errorf("attachment metadata cannot be stripped by the privacy policy")
+		return
+	}
+
 	if len(result.Attachment.MimeType) > 0 {
 		mimetype = result.Attachment.MimeType
 	}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+)
+
+// readImageOrientation reads the EXIF orientation of the image, 1 means the pixels are stored upright
+// The external formats always report 1, their converter applies the transformations already
+func readImageOrientation(ctx context.Context, path string, mimetype string) int {
+	if isExternalImage(mimetype) {
+		return 1
+	}
+
+	// Only print the numeric value of the tag, nothing will be printed if the image has no orientation
+	out, err := runToolCommand(ctx, "exiftool", "-n", "-s3", "-Orientation", path)
+	if err != nil {
+		return 1
+	}
+	orientation, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// isOrientationTransposed reports the orientation swaps the width and the height
+func isOrientationTransposed(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// applyImageOrientation turns the stored pixels upright by the EXIF orientation
+func applyImageOrientation(im image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return im
+	}
+
+	bounds := im.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), im, bounds.Min, draw.Src)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if isOrientationTransposed(orientation) {
+		outWidth, outHeight = height, width
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // Rotated 180
+				dx, dy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Rotated 90 clockwise
+				dx, dy = height-1-y, x
+			case 7: // Transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // Rotated 90 counterclockwise
+				dx, dy = y, width-1-x
+			}
+			copy(out.Pix[out.PixOffset(dx, dy):out.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return out
+}
+
+// NormalizeAttachmentOrientation rotates the pixels of the image in place, so it displays upright without the EXIF orientation
+// The other metadata will be copied back into the re-encoded image, only the JPEG and PNG images are supported
+func NormalizeAttachmentOrientation(file models.Attachment, path string) (bool, error) {
+	if !matchMimeType("image/jpeg", file.MimeType) && !matchMimeType("image/png", file.MimeType) {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if readImageOrientation(ctx, path, file.MimeType) <= 1 {
+		return false, nil
+	} else if isAnimatedImageFile(path, file.MimeType) {
+		// Re-encoding keeps the first frame only
+		return false, nil
+	}
+
+	im, err := decodeImageFile(ctx, file, path)
+	if err != nil {
+		return false, err
+	}
+
+	normalized := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.normalized", file.Uuid))
+	defer os.Remove(normalized)
+
+	writer, err := os.Create(normalized)
+	if err != nil {
+		return false, fmt.Errorf("unable to create file: %v", err)
+	}
+	if matchMimeType("image/png", file.MimeType) {
+		err = png.Encode(writer, im)
+	} else {
+		err = jpeg.Encode(writer, im, &jpeg.Options{Quality: 95})
+	}
+	writer.Close()
+	if err != nil {
+		return false, fmt.Errorf("unable to encode image: %v", err)
+	}
+
+	// Copy the metadata back except the orientation, the pixels are upright now
+	if _, err := runToolCommand(ctx, "exiftool", "-m", "-overwrite_original", "-tagsfromfile", path, "-all:all", "--Orientation", normalized); err != nil {
+		return false, err
+	}
+	if err := os.Rename(normalized, path); err != nil {
+		return false, fmt.Errorf("unable to replace file: %v", err)
+	}
+	return true, nil
+}
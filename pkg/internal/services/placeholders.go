@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/fs"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+	"gopkg.in/vansante/go-ffprobe.v2"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// extractVideoFrame decodes one frame of the video at the offset, scaled down to the size
+func extractVideoFrame(ctx context.Context, path string, offset float64, size int) (image.Image, error) {
+	out, err := runToolCommand(ctx, "ffmpeg",
+		"-v", "error",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64), "-i", path,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", size, size),
+		"-f", "image2pipe", "-c:v", "png", "-",
+	)
+	if err != nil {
+		return nil, err
+	} else if len(out) == 0 && offset > 0 {
+		// Seeking beyond the end produces nothing when the duration is inaccurate
+		return extractVideoFrame(ctx, path, 0, size)
+	}
+
+	im, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode video frame: %v", err)
+	}
+	return im, nil
+}
+
+// computeVideoBlurHash takes the frame at the same position as the poster
+func computeVideoBlurHash(ctx context.Context, path string, duration float64) (string, error) {
+	im, err := extractVideoFrame(ctx, path, min(duration/10, 10), blurHashSampleSize)
+	if err != nil {
+		return "", err
+	}
+	return encodeBlurHash(im)
+}
+
+// PublishPlaceholderTask enqueues the job computing the placeholder of the attachment analyzed before the placeholder existed
+func PublishPlaceholderTask(file models.Attachment) {
+	if _, err := EnqueueJob(database.C, models.JobTypePlaceholder, &file.ID, nil, models.JobPriorityBackground); err != nil {
+		log.Error().Err(err).Uint("id", file.ID).Msg("Unable to enqueue file placeholder task...")
+	}
+}
+
+// ComputeAttachmentPlaceholder computes the blurhash of the attachment in its current destination
+// The files cannot be decoded get an empty blurhash, so they won't be picked up by the backfill again
+func ComputeAttachmentPlaceholder(file models.Attachment) error {
+	if _, ok := file.Metadata["blurhash"]; ok {
+		return nil
+	}
+
+	src, err := fs.DownloadFileToLocal(file, file.Destination)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve file content: %v", err)
+	}
+	if viper.GetString(fmt.Sprintf("destinations.%d.type", file.Destination)) != models.DestinationTypeLocal {
+		defer os.Remove(src)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var hash string
+	if matchMimeType("video/*", file.MimeType) {
+		var duration float64
+		if data, err := ffprobe.ProbeURL(ctx, src); err == nil {
+			duration = data.Format.DurationSeconds
+		}
+		hash, err = computeVideoBlurHash(ctx, src, duration)
+	} else {
+		var im image.Image
+		if im, err = decodeImageFile(ctx, file, src, os.TempDir()); err == nil {
+			hash, err = encodeBlurHash(im)
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Uint("id", file.ID).Msg("Unable to compute placeholder of file...")
+	}
+
+	// Only set the keys of the blurhash, the metadata may be changed by others since read
+	// Keep the same shape as the analyzers, under their namespace and copied to the top level
+	namespace := lo.Ternary(matchMimeType("video/*", file.MimeType), "video", "image")
+	if err := database.C.Model(&file).Update("metadata", gorm.Expr(
+		"jsonb_set(jsonb_set(COALESCE(metadata, '{}'::jsonb), '{blurhash}', to_jsonb(?::text)), ARRAY[?]::text[], COALESCE(metadata->?, '{}'::jsonb) || jsonb_build_object('blurhash', ?::text))",
+		hash, namespace, namespace, hash,
+	)).Error; err != nil {
+		return fmt.Errorf("unable to update file record: %v", err)
+	}
+	return nil
+}
+
+// DoPlaceholderBackfill enqueues the placeholder jobs for the analyzed images and videos without the blurhash
+// It only enqueues a batch every time to avoid flooding the queue, the attachments had the job before will be skipped
+func DoPlaceholderBackfill() {
+	batch := viper.GetInt("placeholders.backfill_batch")
+	if batch <= 0 {
+		batch = 500
+	}
+
+	prefix := viper.GetString("database.prefix")
+	var attachments []models.Attachment
+	if err := database.C.
+		Where("is_analyzed = ? AND status = ? AND parent_id IS NULL", true, models.AttachmentStatusReady).
+		Where("mime_type LIKE ? OR mime_type LIKE ?", "image/%", "video/%").
+		Not(datatypes.JSONQuery("metadata").HasKey("blurhash")).
+		Where(fmt.Sprintf("id NOT IN (SELECT attachment_id FROM %sjobs WHERE type = ? AND attachment_id IS NOT NULL)", prefix), models.JobTypePlaceholder).
+		Order("id DESC").
+		Limit(batch).
+		Find(&attachments).Error; err != nil {
+		log.Error().Err(err).Msg("Unable to find the attachments without placeholder...")
+		return
+	}
+
+	for _, item := range attachments {
+		PublishPlaceholderTask(item)
+	}
+	if len(attachments) > 0 {
+		log.Info().Int("count", len(attachments)).Msg("Enqueued the placeholder tasks for the attachments analyzed before...")
+	}
+}
@@ -1,10 +1,20 @@
 package services
 
 import (
+	"fmt"
+
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
 	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/samber/lo"
 )
 
+func validateAttachmentPoolConfig(config models.AttachmentPoolConfig) error {
+	if len(config.MetadataPolicy) > 0 && !lo.Contains(models.MetadataPolicies, config.MetadataPolicy) {
+		return fmt.Errorf("metadata policy must be one of %v", models.MetadataPolicies)
+	}
+	return nil
+}
+
 func ListAttachmentPool() ([]models.AttachmentPool, error) {
 	var pools []models.AttachmentPool
 	if err := database.C.Find(&pools).Error; err != nil {
@@ -38,6 +48,9 @@ func GetAttachmentPoolWithUser(id uint, userId uint) (models.AttachmentPool, err
 }
 
 func NewAttachmentPool(pool models.AttachmentPool) (models.AttachmentPool, error) {
+	if err := validateAttachmentPoolConfig(pool.Config.Data()); err != nil {
+		return pool, err
+	}
 	if err := database.C.Save(&pool).Error; err != nil {
 		return pool, err
 	}
@@ -45,6 +58,9 @@ func NewAttachmentPool(pool models.AttachmentPool) (models.AttachmentPool, error
 }
 
 func UpdateAttachmentPool(pool models.AttachmentPool) (models.AttachmentPool, error) {
+	if err := validateAttachmentPoolConfig(pool.Config.Data()); err != nil {
+		return pool, err
+	}
 	if err := database.C.Save(&pool).Error; err != nil {
 		return pool, err
 	}
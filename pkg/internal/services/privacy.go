@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/barasher/go-exiftool"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+	"gopkg.in/vansante/go-ffprobe.v2"
+)
+
+// These groups are generated by exiftool from the file system and the other tags, they aren't embedded in the file
+var metadataFileGroups = []string{"ExifTool", "File", "System", "Composite"}
+
+// The tags reveal where the file was taken besides the GPS ones, from the IPTC, XMP and the video containers
+var metadataLocationTags = []string{
+	"Location", "LocationName", "LocationInformation", "LocationCreated", "LocationShown",
+	"City", "State", "Province-State", "Country", "CountryCode", "CountryName",
+	"Country-PrimaryLocationName", "Country-PrimaryLocationCode", "Sub-location", "SubLocation",
+}
+
+func isLocationMetadataTag(tag string) bool {
+	return strings.HasPrefix(tag, "GPS") || lo.Contains(metadataLocationTags, tag)
+}
+
+// splitMetadataKey splits the key like EXIF:Model into the group and the tag
+func splitMetadataKey(key string) (string, string) {
+	if group, tag, ok := strings.Cut(key, ":"); ok {
+		return group, tag
+	}
+	return "", key
+}
+
+// readFileMetadata reads all the metadata of the file, the keys are prefixed with their group like EXIF:Model
+func readFileMetadata(path string) (map[string]any, error) {
+	et, err := exiftool.NewExiftool(exiftool.PrintGroupNames("0"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to start exiftool: %v", err)
+	}
+	defer et.Close()
+
+	data := et.ExtractMetadata(path)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("unable to read metadata")
+	} else if data[0].Err != nil {
+		return nil, fmt.Errorf("unable to read metadata: %v", data[0].Err)
+	}
+	return data[0].Fields, nil
+}
+
+// readEmbeddedMetadata reads the metadata embedded in the file, the ones generated by exiftool are excluded
+func readEmbeddedMetadata(path string) (map[string]any, error) {
+	fields, err := readFileMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	return lo.PickBy(fields, func(key string, _ any) bool {
+		group, _ := splitMetadataKey(key)
+		return !lo.Contains(metadataFileGroups, group)
+	}), nil
+}
+
+// AttachmentPrivacyResult is what the privacy policy of the pool did to the file
+type AttachmentPrivacyResult struct {
+	Policy    string
+	Rewritten bool
+	Stripped  map[string]any
+}
+
+// IsAttachmentPrivacyFailed reports the privacy policy failed on the attachment, it may still contain the metadata should be stripped
+func IsAttachmentPrivacyFailed(file models.Attachment) bool {
+	return cast.ToBool(cast.ToStringMap(file.Metadata["privacy"])["failed"])
+}
+
+// ApplyAttachmentPrivacyPolicy strips the embedded metadata of the file in place by the policy of its pool
+// The file is stripped into a copy first, the fields missing in the copy are the stripped ones.
+// The copy replaces the original one unless the pool only hides the metadata.
+// The result is returned with the error as well, the caller should not serve the file if it failed.
+func ApplyAttachmentPrivacyPolicy(file models.Attachment, path string) (*AttachmentPrivacyResult, error) {
+	var config models.AttachmentPoolConfig
+	if file.Pool != nil {
+		config = file.Pool.Config.Data()
+	}
+	result := &AttachmentPrivacyResult{Policy: config.GetMetadataPolicy()}
+	if result.Policy == models.MetadataPolicyKeepAll {
+		return result, nil
+	}
+
+	before, err := readEmbeddedMetadata(path)
+	if err != nil {
+		return result, err
+	}
+
+	var args []string
+	switch result.Policy {
+	case models.MetadataPolicyStripAll:
+		// Put the orientation and the color profile back, the file cannot be displayed correctly without them
+		args = []string{"-all=", "-tagsfromfile", "@", "-Orientation", "-ICC_Profile"}
+	default:
+		for key := range before {
+			if _, tag := splitMetadataKey(key); isLocationMetadataTag(tag) {
+				args = append(args, fmt.Sprintf("-%s=", key))
+			}
+		}
+	}
+	if len(args) == 0 {
+		return result, nil
+	}
+
+	stripped := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.stripped", file.Uuid))
+	defer os.Remove(stripped)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	args = append(args, "-m", "-o", stripped, path)
+	if _, err := runToolCommand(ctx, "exiftool", args...); err != nil {
+		if !strings.HasPrefix(file.MimeType, "video/") {
+			return result, err
+		}
+		// The containers exiftool cannot write are remuxed without any metadata, the location cannot be picked out there
+		if remuxErr := stripVideoMetadata(ctx, file.MimeType, path, stripped); remuxErr != nil {
+			return result, fmt.Errorf("%v, and unable to remux it with ffmpeg: %v", err, remuxErr)
+		}
+	} else if _, err := os.Stat(stripped); os.IsNotExist(err) {
+		// Nothing was changed, exiftool won't write the copy
+		return result, nil
+	}
+
+	after, err := readEmbeddedMetadata(stripped)
+	if err != nil {
+		return result, err
+	}
+	result.Stripped = lo.OmitByKeys(before, lo.Keys(after))
+
+	if !config.MetadataHideOnly && len(result.Stripped) > 0 {
+		if err := os.Rename(stripped, path); err != nil {
+			return result, fmt.Errorf("unable to replace file: %v", err)
+		}
+		result.Rewritten = true
+	}
+	return result, nil
+}
+
+// The muxers of ffmpeg for the video mimetypes, the others use the format probed from the file
+var videoMuxers = map[string]string{
+	"video/mp4":        "mp4",
+	"video/quicktime":  "mov",
+	"video/webm":       "webm",
+	"video/x-matroska": "matroska",
+}
+
+// stripVideoMetadata copies the streams of the video into the output without the container, stream and chapter metadata
+func stripVideoMetadata(ctx context.Context, mimetype string, path string, out string) error {
+	muxer, ok := videoMuxers[mimetype]
+	if !ok {
+		data, err := ffprobe.ProbeURL(ctx, path)
+		if err != nil {
+			return fmt.Errorf("unable to analyze video information: %v", err)
+		}
+		muxer, _, _ = strings.Cut(data.Format.FormatName, ",")
+	}
+
+	_, err := runToolCommand(ctx, "ffmpeg",
+		"-y", "-v", "error", "-i", path,
+		"-map", "0", "-map_metadata", "-1", "-map_metadata:s", "-1", "-map_chapters", "-1",
+		"-c", "copy", "-f", muxer, out,
+	)
+	return err
+}
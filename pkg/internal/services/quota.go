@@ -0,0 +1,158 @@
+package services
+
+import (
+	"fmt"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/spf13/viper"
+)
+
+type AttachmentUsage struct {
+	Size  int64 `json:"size"`
+	Count int64 `json:"count"`
+}
+
+type AttachmentQuotaInfo struct {
+	Usage    AttachmentUsage `json:"usage"`
+	MaxSize  *int64          `json:"max_size"`
+	MaxCount *int64          `json:"max_count"`
+}
+
+// CountAttachmentUsage sums up the storage used by an account.
+// Attachments that referencing a file of the same account (self ref) won't take the size twice,
+// in-progress fragments are counted too, to prevent bypassing the quota by uploading in parallel.
+// The attachments derived from others (cover arts, thumbnails...) are not counted.
+func CountAttachmentUsage(accountId uint, poolId *uint) (AttachmentUsage, error) {
+	var usage AttachmentUsage
+
+	tx := database.C.Model(&models.Attachment{}).Where("account_id = ? AND parent_id IS NULL", accountId)
+	if poolId != nil {
+		tx = tx.Where("pool_id = ?", *poolId)
+	}
+	if err := tx.Select(
+		"COALESCE(SUM(CASE WHEN ref_id IS NULL OR is_self_ref = ? THEN size ELSE 0 END), 0) AS size, COUNT(*) AS count",
+		false,
+	).Scan(&usage).Error; err != nil {
+		return usage, err
+	}
+
+	var pending AttachmentUsage
+	tx = database.C.Model(&models.AttachmentFragment{}).Where("account_id = ?", accountId)
+	if poolId != nil {
+		tx = tx.Where("pool_id = ?", *poolId)
+	}
+	if err := tx.Select("COALESCE(SUM(size), 0) AS size, COUNT(*) AS count").Scan(&pending).Error; err != nil {
+		return usage, err
+	}
+
+	usage.Size += pending.Size
+	usage.Count += pending.Count
+
+	return usage, nil
+}
+
+// GetAttachmentQuota returns the quota of an account.
+// The account specific quota will be used first, then the pool config (if pool provided) or the global config.
+func GetAttachmentQuota(accountId uint, pool *models.AttachmentPool) (maxSize *int64, maxCount *int64) {
+	if pool != nil {
+		maxSize = pool.Config.Data().AccountQuotaSize
+		maxCount = pool.Config.Data().AccountQuotaCount
+	} else {
+		if val := viper.GetInt64("quota.max_size"); val > 0 {
+			maxSize = &val
+		}
+		if val := viper.GetInt64("quota.max_count"); val > 0 {
+			maxCount = &val
+		}
+	}
+
+	var quota models.AttachmentQuota
+	tx := database.C.Where("account_id = ?", accountId)
+	if pool != nil {
+		tx = tx.Where("pool_id = ?", pool.ID)
+	} else {
+		tx = tx.Where("pool_id IS NULL")
+	}
+	if err := tx.First(&quota).Error; err == nil {
+		if quota.MaxSize != nil {
+			maxSize = quota.MaxSize
+		}
+		if quota.MaxCount != nil {
+			maxCount = quota.MaxCount
+		}
+	}
+
+	return
+}
+
+func GetAttachmentQuotaInfo(accountId uint, pool *models.AttachmentPool) (AttachmentQuotaInfo, error) {
+	var info AttachmentQuotaInfo
+	var poolId *uint
+	if pool != nil {
+		poolId = &pool.ID
+	}
+
+	usage, err := CountAttachmentUsage(accountId, poolId)
+	if err != nil {
+		return info, err
+	}
+
+	info.Usage = usage
+	info.MaxSize, info.MaxCount = GetAttachmentQuota(accountId, pool)
+	return info, nil
+}
+
+// CheckAttachmentQuota will check both the account's global quota and quota in the target pool
+// Returns an error if the new file with the provided size will exceed any of them
+func CheckAttachmentQuota(accountId uint, pool models.AttachmentPool, size int64) error {
+	return CheckAttachmentQuotaWithCount(accountId, pool, size, 1)
+}
+
+// CheckAttachmentQuotaWithCount is same as CheckAttachmentQuota but for creating multiple files at once
+func CheckAttachmentQuotaWithCount(accountId uint, pool models.AttachmentPool, size int64, count int64) error {
+	for _, target := range []*models.AttachmentPool{nil, &pool} {
+		info, err := GetAttachmentQuotaInfo(accountId, target)
+		if err != nil {
+			return fmt.Errorf("unable to count attachment usage: %v", err)
+		}
+
+		scope := "your account"
+		if target != nil {
+			scope = fmt.Sprintf("attachment pool %s", target.Alias)
+		}
+
+		if info.MaxSize != nil && info.Usage.Size+size > *info.MaxSize {
+			return fmt.Errorf("%s storage quota exceeded, used %d of %d bytes", scope, info.Usage.Size, *info.MaxSize)
+		}
+		if info.MaxCount != nil && info.Usage.Count+count > *info.MaxCount {
+			return fmt.Errorf("%s file quota exceeded, used %d of %d files", scope, info.Usage.Count, *info.MaxCount)
+		}
+	}
+
+	return nil
+}
+
+func SetAttachmentQuota(accountId uint, pool *models.AttachmentPool, maxSize, maxCount *int64) (models.AttachmentQuota, error) {
+	var quota models.AttachmentQuota
+	tx := database.C.Where("account_id = ?", accountId)
+	if pool != nil {
+		tx = tx.Where("pool_id = ?", pool.ID)
+	} else {
+		tx = tx.Where("pool_id IS NULL")
+	}
+	if err := tx.First(&quota).Error; err != nil {
+		quota = models.AttachmentQuota{AccountID: accountId}
+		if pool != nil {
+			quota.PoolID = &pool.ID
+		}
+	}
+
+	quota.MaxSize = maxSize
+	quota.MaxCount = maxCount
+
+	if err := database.C.Save(&quota).Error; err != nil {
+		return quota, err
+	}
+	return quota, nil
+}
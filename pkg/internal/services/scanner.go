@@ -0,0 +1,143 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+type FileScanVerdict struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature"`
+}
+
+// FileScanner is the interface of the malware scanner stage in the analyze pipeline
+// Implement this and assign it to Scanner to replace the default one
+type FileScanner interface {
+	Scan(ctx context.Context, path string) (FileScanVerdict, error)
+}
+
+// Scanner is the scanner used while analyzing, nil means the scanning is disabled
+var Scanner FileScanner
+
+func ConfigureFileScanner() {
+	switch viper.GetString("scanner.type") {
+	case "clamd":
+		network, address, ok := strings.Cut(viper.GetString("scanner.addr"), "://")
+		if !ok {
+			log.Warn().Str("addr", viper.GetString("scanner.addr")).Msg("Invalid scanner address, the malware scanning will be disabled...")
+			return
+		}
+		Scanner = &ClamdScanner{
+			Network:   network,
+			Address:   address,
+			ChunkSize: 64 * 1024,
+		}
+		log.Info().Str("network", network).Str("addr", address).Msg("Malware scanner configured with clamd.")
+	default:
+		Scanner = nil
+	}
+}
+
+// ClamdScanner scans files via the INSTREAM command of clamd
+// The file will be streamed over the socket, so the clamd doesn't need to access the file system of us
+type ClamdScanner struct {
+	Network   string // unix or tcp
+	Address   string
+	ChunkSize int // Size of each chunk streamed, the files larger than the StreamMaxLength in clamd config get an error from clamd
+}
+
+func (v *ClamdScanner) Scan(ctx context.Context, path string) (FileScanVerdict, error) {
+	var verdict FileScanVerdict
+
+	file, err := os.Open(path)
+	if err != nil {
+		return verdict, fmt.Errorf("unable to open file: %v", err)
+	}
+	defer file.Close()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, v.Network, v.Address)
+	if err != nil {
+		return verdict, fmt.Errorf("unable to connect clamd: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return verdict, fmt.Errorf("unable to send command to clamd: %v", err)
+	}
+
+	buf := make([]byte, v.ChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return verdict, fmt.Errorf("unable to stream file to clamd: %v", err)
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return verdict, fmt.Errorf("unable to stream file to clamd: %v", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return verdict, fmt.Errorf("unable to read file: %v", err)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return verdict, fmt.Errorf("unable to stream file to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return verdict, fmt.Errorf("unable to read reply from clamd: %v", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return verdict, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		verdict.Infected = true
+		verdict.Signature = strings.TrimSuffix(reply, " FOUND")
+		return verdict, nil
+	default:
+		return verdict, fmt.Errorf("clamd reported an error: %s", reply)
+	}
+}
+
+// ScanAttachmentFile runs the configured scanner on a file in the temporary storage
+// Returns nil verdict if the scanning is disabled
+func ScanAttachmentFile(path string) (*FileScanVerdict, error) {
+	if Scanner == nil {
+		return nil, nil
+	}
+
+	timeout := viper.GetDuration("scanner.timeout")
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	verdict, err := Scanner.Scan(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &verdict, nil
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveFakeClamd answers the INSTREAM command like clamd, the streams containing the marker are reported as infected
+func serveFakeClamd(t *testing.T, listener net.Listener, marker []byte) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			if command, err := reader.ReadString('\x00'); err != nil || command != "zINSTREAM\x00" {
+				t.Errorf("unexpected command %q: %v", command, err)
+				return
+			}
+
+			var content []byte
+			size := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(reader, size); err != nil {
+					t.Errorf("unable to read chunk size: %v", err)
+					return
+				}
+				length := binary.BigEndian.Uint32(size)
+				if length == 0 {
+					break
+				}
+				chunk := make([]byte, length)
+				if _, err := io.ReadFull(reader, chunk); err != nil {
+					t.Errorf("unable to read chunk: %v", err)
+					return
+				}
+				content = append(content, chunk...)
+			}
+
+			if bytes.Contains(content, marker) {
+				_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				_, _ = conn.Write([]byte("stream: OK\x00"))
+			}
+		}(conn)
+	}
+}
+
+func TestClamdScannerScan(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+	marker := []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")
+	go serveFakeClamd(t, listener, marker)
+
+	scanner := &ClamdScanner{Network: "tcp", Address: listener.Addr().String(), ChunkSize: 7}
+	cases := []struct {
+		Name      string
+		Content   []byte
+		Infected  bool
+		Signature string
+	}{
+		{Name: "clean", Content: []byte("just a normal file")},
+		{Name: "empty", Content: []byte{}},
+		{Name: "infected", Content: append([]byte("prefix "), marker...), Infected: true, Signature: "Eicar-Test-Signature"},
+	}
+
+	for _, item := range cases {
+		t.Run(item.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, item.Content, 0644); err != nil {
+				t.Fatalf("unable to write file: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			verdict, err := scanner.Scan(ctx, path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if verdict.Infected != item.Infected || verdict.Signature != item.Signature {
+				t.Errorf("got verdict %+v, want infected %v with signature %q", verdict, item.Infected, item.Signature)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/samber/lo"
+	"golang.org/x/image/draw"
+	"gorm.io/gorm"
+)
+
+// computeDHash computes the difference hash of the image
+// The image is scaled into 9x8 grayscale pixels, every bit tells whether a pixel is brighter than its right neighbor
+func computeDHash(im image.Image) int64 {
+	sample := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(sample, sample.Bounds(), im, im.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if sample.GrayAt(x, y).Y > sample.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	// Stored as the signed integer, postgres doesn't have the unsigned one
+	return int64(hash)
+}
+
+// The hamming distance between the stored hash and the given one, counted by the bits of xor
+const perceptualDistanceExpr = "length(replace(((perceptual_hash # ?::bigint)::bit(64))::text, '0', ''))"
+
+// MaxPerceptualDistance is the largest distance can be searched
+// Each band is looked up with all the values within the distance/4, the larger ones make the lookup too wide
+const MaxPerceptualDistance = 15
+
+// perceptualBandNeighbors lists the 16-bit values within the distance of the band
+func perceptualBandNeighbors(band int, distance int) []int {
+	var out []int
+	for val := 0; val <= 0xffff; val++ {
+		if bits.OnesCount16(uint16(val^band)) <= distance {
+			out = append(out, val)
+		}
+	}
+	return out
+}
+
+type similarMatch struct {
+	ID       uint
+	Distance int
+}
+
+type SimilarAttachment struct {
+	Attachment models.Attachment `json:"attachment"`
+	Distance   int               `json:"distance"`
+}
+
+// ListSimilarAttachments finds the attachments whose perceptual hash is close to the file, the closer ones come first
+// The tx should be scoped to the attachments the requester can see
+// The candidates sharing a close band are picked by the band indexes first, then checked by the exact distance
+func ListSimilarAttachments(tx *gorm.DB, file models.Attachment, distance int, take int, offset int) ([]SimilarAttachment, int64, error) {
+	if file.PerceptualHash == nil {
+		return nil, 0, fmt.Errorf("attachment has no perceptual hash")
+	} else if distance < 0 || distance > MaxPerceptualDistance {
+		return nil, 0, fmt.Errorf("distance must be between 0 and %d", MaxPerceptualDistance)
+	}
+
+	// Split the hash by the same way as the stored bands
+	var probe models.Attachment
+	probe.SetPerceptualHash(file.PerceptualHash)
+	radius := distance / 4
+
+	tx = tx.Model(&models.Attachment{}).
+		Where(
+			"perceptual_hash_band0 IN ? OR perceptual_hash_band1 IN ? OR perceptual_hash_band2 IN ? OR perceptual_hash_band3 IN ?",
+			perceptualBandNeighbors(*probe.PerceptualHashBand0, radius),
+			perceptualBandNeighbors(*probe.PerceptualHashBand1, radius),
+			perceptualBandNeighbors(*probe.PerceptualHashBand2, radius),
+			perceptualBandNeighbors(*probe.PerceptualHashBand3, radius),
+		).
+		Where("perceptual_hash IS NOT NULL AND id <> ? AND parent_id IS NULL", file.ID).
+		Where("is_quarantined = ? AND cleaned_at IS NULL", false).
+		Where(perceptualDistanceExpr+" <= ?", *file.PerceptualHash, distance).
+		Session(&gorm.Session{})
+
+	var count int64
+	if err := tx.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var matches []similarMatch
+	if err := tx.
+		Select("id, "+perceptualDistanceExpr+" AS distance", *file.PerceptualHash).
+		Order("distance ASC, id DESC").
+		Limit(take).Offset(offset).
+		Scan(&matches).Error; err != nil {
+		return nil, count, err
+	}
+
+	var attachments []models.Attachment
+	if err := database.C.
+		Where("id IN ?", lo.Map(matches, func(item similarMatch, _ int) uint {
+			return item.ID
+		})).
+		Preload("Pool").
+		Preload("Thumbnail").
+		Preload("Compressed").
+		Find(&attachments).Error; err != nil {
+		return nil, count, err
+	}
+
+	out := make([]SimilarAttachment, 0, len(matches))
+	for _, match := range matches {
+		if item, ok := lo.Find(attachments, func(item models.Attachment) bool {
+			return item.ID == match.ID
+		}); ok {
+			out = append(out, SimilarAttachment{Attachment: item, Distance: match.Distance})
+		}
+	}
+	return out, count, nil
+}
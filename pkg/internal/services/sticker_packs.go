@@ -49,6 +49,7 @@ func UpdateStickerPack(pack models.StickerPack) (models.StickerPack, error) {
 	if err := database.C.Save(&pack).Error; err != nil {
 		return pack, err
 	}
+	PublishStickerPackUpdated(pack, false)
 	return pack, nil
 }
 
@@ -56,5 +57,6 @@ func DeleteStickerPack(pack models.StickerPack) (models.StickerPack, error) {
 	if err := database.C.Delete(&pack).Error; err != nil {
 		return pack, err
 	}
+	PublishStickerPackUpdated(pack, true)
 	return pack, nil
 }
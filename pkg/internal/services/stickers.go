@@ -55,6 +55,7 @@ func NewSticker(sticker models.Sticker) (models.Sticker, error) {
 	if err := database.C.Save(&sticker).Error; err != nil {
 		return sticker, err
 	}
+	publishStickerChanged(sticker)
 	return sticker, nil
 }
 
@@ -62,6 +63,7 @@ func UpdateSticker(sticker models.Sticker) (models.Sticker, error) {
 	if err := database.C.Save(&sticker).Error; err != nil {
 		return sticker, err
 	}
+	publishStickerChanged(sticker)
 	return sticker, nil
 }
 
@@ -69,5 +71,12 @@ func DeleteSticker(sticker models.Sticker) (models.Sticker, error) {
 	if err := database.C.Delete(&sticker).Error; err != nil {
 		return sticker, err
 	}
+	publishStickerChanged(sticker)
 	return sticker, nil
 }
+
+func publishStickerChanged(sticker models.Sticker) {
+	if pack, err := GetStickerPack(sticker.PackID); err == nil {
+		PublishStickerPackUpdated(pack, false)
+	}
+}
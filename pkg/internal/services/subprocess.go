@@ -0,0 +1,84 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// getToolPath returns the path of the external tool, it can be configured by tools.<name>
+func getToolPath(name string) string {
+	if path := viper.GetString(fmt.Sprintf("tools.%s", name)); len(path) > 0 {
+		return path
+	}
+	return name
+}
+
+// isToolAvailable reports the external tool can be found, for the optional tools
+func isToolAvailable(name string) bool {
+	_, err := exec.LookPath(getToolPath(name))
+	return err == nil
+}
+
+// getToolLimiter returns the prlimit arguments capping the resources of the external tools
+// The tools decode the untrusted files, a crafted one may exhaust the memory of the whole server
+// Nothing will be returned if no limit configured or prlimit cannot be found, like on the non-linux systems
+var getToolLimiter = sync.OnceValue(func() []string {
+	var args []string
+	if val := viper.GetInt64("tools.max_memory"); val > 0 {
+		args = append(args, fmt.Sprintf("--as=%d", val))
+	}
+	if val := viper.GetDuration("tools.max_cpu_time"); val > 0 {
+		args = append(args, fmt.Sprintf("--cpu=%d", int64(val.Seconds())))
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	path, err := exec.LookPath(getToolPath("prlimit"))
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to find prlimit, the external tools will run without the resource limits...")
+		return nil
+	}
+	return append([]string{path}, args...)
+})
+
+// newToolCommand creates the command of the external tool, it will be killed when the context is done
+func newToolCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	path := getToolPath(name)
+	if limiter := getToolLimiter(); len(limiter) > 0 {
+		args = append(append(append([]string{}, limiter[1:]...), "--", path), args...)
+		path = limiter[0]
+	}
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	// Don't wait forever for the pipes held by the grandchildren after the tool was killed
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// runToolCommand runs the external tool and returns what it printed
+// The tail of the stderr will be included in the error to help figure out what happened
+func runToolCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := newToolCommand(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 512 {
+			msg = msg[len(msg)-512:]
+		}
+		return nil, fmt.Errorf("%s failed: %v: %s", name, err, msg)
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,398 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/fs"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"gopkg.in/vansante/go-ffprobe.v2"
+	"gorm.io/datatypes"
+)
+
+// The HLS outputs are saved as the child attachments of the video
+// Each rendition has one fragmented mp4 file with the byte ranges playlist, so the mp4 can be played directly too
+const (
+	hlsDerivedPlaylist  = "hls_playlist"
+	hlsDerivedRendition = "hls_rendition"
+)
+
+// getHlsRenditions returns the heights of the ladder from the low to the high
+func getHlsRenditions(pool *models.AttachmentPool) []int {
+	var heights []int
+	if pool != nil {
+		heights = pool.Config.Data().HLSRenditions
+	}
+	if len(heights) == 0 {
+		heights = viper.GetIntSlice("hls.renditions")
+	}
+	if len(heights) == 0 {
+		heights = []int{360, 720, 1080}
+	}
+	heights = lo.Uniq(lo.Filter(heights, func(item int, _ int) bool {
+		return item > 0
+	}))
+	sort.Ints(heights)
+	return heights
+}
+
+// getHlsBitrate estimates the video bitrate in kbps by the height of the rendition
+func getHlsBitrate(height int) int {
+	return max(400, height*height*5/1152)
+}
+
+// ShouldTranscodeAttachment reports the attachment needs the HLS renditions
+func ShouldTranscodeAttachment(file models.Attachment) bool {
+	if file.ParentID != nil || file.RefID != nil || file.Type != models.AttachmentTypeNormal {
+		return false
+	} else if file.Pool == nil || !file.Pool.Config.Data().EnableHLS {
+		return false
+	}
+	return matchMimeType("video/*", file.MimeType)
+}
+
+// PublishTranscodeTask enqueues the job transcoding the video into the HLS renditions
+func PublishTranscodeTask(file models.Attachment, priority ...int) {
+	if _, err := EnqueueJob(database.C, models.JobTypeTranscode, &file.ID, nil, lo.FirstOr(priority, models.JobPriorityBackground)); err != nil {
+		log.Error().Err(err).Uint("id", file.ID).Msg("Unable to enqueue file transcode task...")
+	}
+}
+
+type hlsRendition struct {
+	Height     int    // The height in the ladder, it is the short side of the output
+	Resolution string // The actual size of the output like 1280x720
+	Bandwidth  int
+	Playlist   string
+	Media      string
+	Files      []string // The files referred by the playlist, including the media
+}
+
+// TranscodeAttachment transcodes the video in the permanent storage into the HLS ladder
+// The renditions will be the children of the attachment, and the default one will be used as the compressed version
+func TranscodeAttachment(file models.Attachment) error {
+	if playlists, err := GetAttachmentHlsPlaylists(file, false); err == nil && len(playlists) > 0 {
+		// Transcoded by the previous attempt
+		return nil
+	}
+
+	start := time.Now()
+
+	src, err := fs.DownloadFileToLocal(file, file.Destination)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve file content: %v", err)
+	}
+	if viper.GetString(fmt.Sprintf("destinations.%d.type", file.Destination)) != models.DestinationTypeLocal {
+		defer os.Remove(src)
+	}
+
+	// Keep the work dir in the same filesystem as the temporary storage, so the renditions can be moved instead of copied
+	destMap := viper.GetStringMapString("destinations.0")
+	workDir, err := os.MkdirTemp(destMap["path"], fmt.Sprintf(".%s-hls-*", file.Uuid))
+	if err != nil {
+		return fmt.Errorf("unable to create work dir: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	timeout := viper.GetDuration("hls.timeout")
+	if timeout <= 0 {
+		timeout = 2 * time.Hour
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	data, err := ffprobe.ProbeURL(ctx, src)
+	if err != nil {
+		return fmt.Errorf("unable to analyze video information: %v", err)
+	}
+	stream := data.FirstVideoStream()
+	if stream == nil {
+		return fmt.Errorf("no video stream found")
+	}
+
+	// Compare with the short side, the portrait videos shouldn't be treated as the low resolution ones
+	short := min(stream.Width, stream.Height)
+	heights := lo.Filter(getHlsRenditions(file.Pool), func(item int, _ int) bool {
+		return item <= short
+	})
+	if len(heights) == 0 {
+		heights = []int{short / 2 * 2}
+	}
+
+	var renditions []hlsRendition
+	for _, height := range heights {
+		rendition, err := encodeHlsRendition(ctx, src, workDir, height, data.FirstAudioStream() != nil)
+		if err != nil {
+			return err
+		}
+		renditions = append(renditions, rendition)
+	}
+
+	defaultHeight := viper.GetInt("hls.default")
+	if defaultHeight <= 0 {
+		defaultHeight = 720
+	}
+	defaultRendition := renditions[0]
+	for _, item := range renditions {
+		if item.Height <= defaultHeight {
+			defaultRendition = item
+		}
+	}
+
+	baseName := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
+	var derived []AttachmentDerivedFile
+	var defaultMediaRid string
+	for _, item := range renditions {
+		refs := make(map[string]string)
+		for _, name := range item.Files {
+			rid := RandString(16)
+			refs[name] = rid
+			derived = append(derived, AttachmentDerivedFile{
+				Path:     filepath.Join(filepath.Dir(item.Playlist), name),
+				Name:     fmt.Sprintf("%s.%dp%s", baseName, item.Height, lo.Ternary(name == item.Media, ".mp4", ".init.mp4")),
+				MimeType: "video/mp4",
+				Type:     models.AttachmentTypeCompressed,
+				Metadata: map[string]any{"derived": hlsDerivedRendition, "height": item.Height},
+				Rid:      rid,
+			})
+		}
+		// The separated init segment means the media cannot be played without the playlist
+		if item.Height == defaultRendition.Height && len(item.Files) == 1 {
+			defaultMediaRid = refs[item.Media]
+		}
+
+		if err := rewriteHlsPlaylist(item.Playlist, refs); err != nil {
+			return err
+		}
+		derived = append(derived, AttachmentDerivedFile{
+			Path:     item.Playlist,
+			Name:     fmt.Sprintf("%s.%dp.m3u8", baseName, item.Height),
+			MimeType: "application/vnd.apple.mpegurl",
+			Type:     models.AttachmentTypeCompressed,
+			Metadata: map[string]any{
+				"derived":    hlsDerivedPlaylist,
+				"height":     item.Height,
+				"resolution": item.Resolution,
+				"bandwidth":  item.Bandwidth,
+			},
+		})
+	}
+
+	tx := database.C.Begin()
+
+	children, err := SaveDerivedAttachments(tx, &file, derived)
+	if err != nil {
+		tx.Rollback()
+		discardDerivedAttachments(children)
+		return err
+	}
+
+	if file.Metadata == nil {
+		file.Metadata = make(map[string]any)
+	}
+	file.Metadata["hls"] = map[string]any{
+		"renditions": lo.Map(renditions, func(item hlsRendition, _ int) int {
+			return item.Height
+		}),
+		"default": defaultRendition.Height,
+	}
+	if file.CompressedID == nil && len(defaultMediaRid) > 0 {
+		for _, child := range children {
+			if child.Rid == defaultMediaRid {
+				file.CompressedID = &child.ID
+			}
+		}
+	}
+	if err := tx.Model(&file).Updates(&models.Attachment{
+		Metadata:     file.Metadata,
+		CompressedID: file.CompressedID,
+	}).Error; err != nil {
+		tx.Rollback()
+		discardDerivedAttachments(children)
+		return fmt.Errorf("unable to update file record: %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		discardDerivedAttachments(children)
+		return fmt.Errorf("unable to save derived attachments: %v", err)
+	}
+
+	for _, child := range children {
+		PublishAnalyzeTask(child)
+	}
+
+	log.Info().Dur("elapsed", time.Since(start)).Uint("id", file.ID).Ints("renditions", heights).Msg("A file transcode task was finished.")
+
+	return nil
+}
+
+// encodeHlsRendition encodes one rendition into its own dir, the short side of the output will be the height
+func encodeHlsRendition(ctx context.Context, src, workDir string, height int, hasAudio bool) (hlsRendition, error) {
+	dir := filepath.Join(workDir, strconv.Itoa(height))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return hlsRendition{}, fmt.Errorf("unable to create rendition dir: %v", err)
+	}
+
+	preset := viper.GetString("hls.preset")
+	if len(preset) == 0 {
+		preset = "veryfast"
+	}
+	segment := viper.GetInt("hls.segment_duration")
+	if segment <= 0 {
+		segment = 6
+	}
+
+	bitrate := getHlsBitrate(height)
+	audioBitrate := lo.Ternary(hasAudio, 128, 0)
+	media := fmt.Sprintf("%dp.mp4", height)
+	playlist := filepath.Join(dir, fmt.Sprintf("%dp.m3u8", height))
+
+	args := []string{
+		"-v", "error", "-i", src,
+		"-map", "0:v:0", "-map", "0:a:0?", "-map_metadata", "-1",
+		"-vf", fmt.Sprintf("scale='if(gt(iw,ih),-2,%d)':'if(gt(iw,ih),%d,-2)'", height, height),
+		"-c:v", "libx264", "-preset", preset, "-profile:v", "main", "-pix_fmt", "yuv420p",
+		"-b:v", fmt.Sprintf("%dk", bitrate),
+		"-maxrate", fmt.Sprintf("%dk", bitrate*3/2),
+		"-bufsize", fmt.Sprintf("%dk", bitrate*2),
+		// Align the keyframes with the segments, the players switch the renditions at the segment boundaries
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segment),
+	}
+	if hasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audioBitrate), "-ac", "2")
+	}
+	args = append(args,
+		"-f", "hls", "-hls_time", strconv.Itoa(segment), "-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4", "-hls_flags", "single_file",
+		"-hls_segment_filename", filepath.Join(dir, media),
+		"-y", playlist,
+	)
+	if _, err := runToolCommand(ctx, "ffmpeg", args...); err != nil {
+		return hlsRendition{}, fmt.Errorf("unable to transcode %dp rendition: %v", height, err)
+	}
+
+	rendition := hlsRendition{
+		Height:    height,
+		Bandwidth: (bitrate*3/2 + audioBitrate) * 1000,
+		Playlist:  playlist,
+		Media:     media,
+	}
+
+	content, err := os.ReadFile(playlist)
+	if err != nil {
+		return rendition, fmt.Errorf("unable to read %dp playlist: %v", height, err)
+	}
+	for _, name := range parseHlsPlaylistRefs(string(content)) {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return rendition, fmt.Errorf("the %dp playlist refers to a missing file %s", height, name)
+		}
+		rendition.Files = append(rendition.Files, name)
+	}
+
+	if data, err := ffprobe.ProbeURL(ctx, filepath.Join(dir, media)); err == nil && data.FirstVideoStream() != nil {
+		rendition.Resolution = fmt.Sprintf("%dx%d", data.FirstVideoStream().Width, data.FirstVideoStream().Height)
+	}
+
+	return rendition, nil
+}
+
+// parseHlsPlaylistRefs returns the files referred by the playlist, both the segments and the URI attributes
+func parseHlsPlaylistRefs(content string) []string {
+	var refs []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			refs = append(refs, line)
+		} else if _, after, ok := strings.Cut(line, `URI="`); ok {
+			if uri, _, ok := strings.Cut(after, `"`); ok {
+				refs = append(refs, uri)
+			}
+		}
+	}
+	return lo.Uniq(refs)
+}
+
+// rewriteHlsPlaylist replaces the file names in the playlist with the rid of the attachments
+// The playlist will be served at /attachments/:id/hls/:rendition, so the attachments are two levels up
+func rewriteHlsPlaylist(path string, refs map[string]string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read playlist: %v", err)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	for idx, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "#") {
+			if rid, ok := refs[trimmed]; ok {
+				lines[idx] = "../../" + rid
+			}
+			continue
+		}
+		for name, rid := range refs {
+			lines[idx] = strings.ReplaceAll(lines[idx], fmt.Sprintf(`URI="%s"`, name), fmt.Sprintf(`URI="../../%s"`, rid))
+		}
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// GetAttachmentHlsPlaylists returns the rendition playlists of the attachment from the low to the high
+func GetAttachmentHlsPlaylists(file models.Attachment, readyOnly bool) ([]models.Attachment, error) {
+	tx := database.C.
+		Where("parent_id = ?", file.ID).
+		Where(datatypes.JSONQuery("metadata").Equals(hlsDerivedPlaylist, "derived"))
+	if readyOnly {
+		tx = tx.Where("status = ?", models.AttachmentStatusReady)
+	}
+
+	var playlists []models.Attachment
+	if err := tx.Find(&playlists).Error; err != nil {
+		return nil, err
+	}
+	sort.Slice(playlists, func(i, j int) bool {
+		return cast.ToInt(playlists[i].Metadata["height"]) < cast.ToInt(playlists[j].Metadata["height"])
+	})
+	return playlists, nil
+}
+
+// BuildHlsMasterPlaylist lists the ready renditions, they are referred by the name like 720p.m3u8
+func BuildHlsMasterPlaylist(playlists []models.Attachment) string {
+	var out strings.Builder
+	out.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for _, item := range playlists {
+		out.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", cast.ToInt(item.Metadata["bandwidth"])))
+		if resolution := cast.ToString(item.Metadata["resolution"]); len(resolution) > 0 {
+			out.WriteString(",RESOLUTION=" + resolution)
+		}
+		out.WriteString(fmt.Sprintf("\n%dp.m3u8\n", cast.ToInt(item.Metadata["height"])))
+	}
+	return out.String()
+}
+
+// ReadHlsPlaylist reads the content of the rendition playlist from its destination
+func ReadHlsPlaylist(playlist models.Attachment) ([]byte, error) {
+	reader, err := fs.OpenFileReader(playlist, playlist.Destination)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/fs"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+	"golang.org/x/image/draw"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	AttachmentTransformFitContain = "contain" // Scale to fit in the box, keep the ratio
+	AttachmentTransformFitCover   = "cover"   // Scale to fill the box and crop the overflowed part
+	AttachmentTransformFitFill    = "fill"    // Stretch to the box, ignore the ratio
+)
+
+// The requested sizes are rounded up to these steps, the variants of one image will be limited
+var attachmentTransformSizes = []int{64, 128, 256, 320, 480, 640, 768, 1024, 1280, 1600, 1920, 2560}
+
+// AttachmentTransform is the parameters transforming an image when opening it
+type AttachmentTransform struct {
+	Width   int     `query:"w"`
+	Height  int     `query:"h"`
+	Fit     string  `query:"fit"`
+	Format  string  `query:"format"`
+	Quality int     `query:"q"`
+	Dpr     float64 `query:"dpr"`
+}
+
+// IsEmpty reports no transform was requested
+func (v AttachmentTransform) IsEmpty() bool {
+	return v.Width == 0 && v.Height == 0 && len(v.Fit) == 0 && len(v.Format) == 0 && v.Quality == 0 && v.Dpr == 0
+}
+
+// Normalize validates the parameters and snaps them to the allowed values
+// The format will be picked by the Accept header if not provided, fall back to the lossless one for the lossless originals
+func (v AttachmentTransform) Normalize(accept string, mimetype string) (AttachmentTransform, error) {
+	if v.Width < 0 || v.Height < 0 {
+		return v, fmt.Errorf("width and height cannot be negative")
+	}
+
+	if v.Dpr == 0 {
+		v.Dpr = 1
+	} else if v.Dpr < 1 || v.Dpr > 3 {
+		return v, fmt.Errorf("dpr must be between 1 and 3")
+	}
+	// Only the integer dpr is allowed, like the 1x, 2x, 3x images
+	v.Width = snapTransformSize(int(math.Ceil(float64(v.Width) * math.Ceil(v.Dpr))))
+	v.Height = snapTransformSize(int(math.Ceil(float64(v.Height) * math.Ceil(v.Dpr))))
+	v.Dpr = 1
+
+	switch v.Fit {
+	case "":
+		v.Fit = AttachmentTransformFitContain
+	case AttachmentTransformFitContain, AttachmentTransformFitCover, AttachmentTransformFitFill:
+	default:
+		return v, fmt.Errorf("unsupported fit mode %s", v.Fit)
+	}
+	if v.Fit != AttachmentTransformFitContain && (v.Width == 0 || v.Height == 0) {
+		// Without the box, the other modes act as the same as the contain mode
+		v.Fit = AttachmentTransformFitContain
+	}
+
+	if v.Quality == 0 {
+		v.Quality = 75
+	} else if v.Quality < 1 || v.Quality > 100 {
+		return v, fmt.Errorf("quality must be between 1 and 100")
+	}
+	// Round up to the multiple of 10
+	v.Quality = min(100, (v.Quality+9)/10*10)
+
+	switch v.Format {
+	case "":
+		v.Format = lo.Ternary(matchMimeType("image/jpeg", mimetype), "jpeg", "png")
+		for _, format := range compressedFormats {
+			name := strings.TrimPrefix(format.Ext, ".")
+			if isMimeTypeAccepted(accept, format.MimeType) && isTransformFormatAvailable(name) {
+				v.Format = name
+				break
+			}
+		}
+	case "jpeg", "png":
+	case "webp", "avif":
+		if !isTransformFormatAvailable(v.Format) {
+			return v, fmt.Errorf("format %s is not available", v.Format)
+		}
+	default:
+		return v, fmt.Errorf("unsupported format %s", v.Format)
+	}
+
+	return v, nil
+}
+
+func (v AttachmentTransform) String() string {
+	return fmt.Sprintf("w%d-h%d-%s-q%d.%s", v.Width, v.Height, v.Fit, v.Quality, v.Format)
+}
+
+func (v AttachmentTransform) MimeType() string {
+	return "image/" + v.Format
+}
+
+func snapTransformSize(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	for _, step := range attachmentTransformSizes {
+		if size <= step {
+			return step
+		}
+	}
+	return attachmentTransformSizes[len(attachmentTransformSizes)-1]
+}
+
+func isTransformFormatAvailable(name string) bool {
+	for _, format := range compressedFormats {
+		if format.Ext == "."+name {
+			return isToolAvailable(format.Tool)
+		}
+	}
+	return false
+}
+
+func getTransformCachePath() string {
+	path := viper.GetString("transforms.cache_path")
+	if len(path) == 0 {
+		path = filepath.Join(os.TempDir(), "paperclip-transforms")
+	}
+	return path
+}
+
+// The same variant requested at the same time will only be generated once
+var transformGroup singleflight.Group
+
+// getTransformSemaphore limits the images being transformed at the same time
+var getTransformSemaphore = sync.OnceValue(func() chan struct{} {
+	concurrency := viper.GetInt("transforms.concurrency")
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	return make(chan struct{}, concurrency)
+})
+
+// TransformAttachment returns the path of the transformed image in the derived objects store
+// The variants are keyed by the hash of the content, the attachments linked to the same file share them
+func TransformAttachment(rid string, transform AttachmentTransform) (string, error) {
+	file, err := GetAttachmentByRID(rid)
+	if err != nil {
+		return "", err
+	} else if file.IsQuarantined {
+		return "", fmt.Errorf("attachment was quarantined")
+	} else if IsAttachmentPrivacyFailed(file) {
+		return "", fmt.Errorf("attachment metadata cannot be stripped by the privacy policy")
+	} else if !matchMimeType("image/*", file.MimeType) {
+		return "", fmt.Errorf("only images can be transformed")
+	}
+
+	maxSize := viper.GetInt64("transforms.max_source_size")
+	if maxSize <= 0 {
+		maxSize = 50 * 1024 * 1024
+	}
+	if file.Size > maxSize {
+		return "", fmt.Errorf("attachment is too large to transform")
+	}
+
+	source := file.HashCode
+	if len(source) == 0 {
+		source = file.Uuid
+	}
+	checksum := sha256.Sum256([]byte(source + "/" + transform.String()))
+	key := hex.EncodeToString(checksum[:])
+	path := filepath.Join(getTransformCachePath(), key[:2], key+"."+transform.Format)
+
+	if _, err := os.Stat(path); err == nil {
+		// Touch it to keep it away from the cleanup
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+		return path, nil
+	}
+
+	_, err, _ = transformGroup.Do(key, func() (any, error) {
+		sem := getTransformSemaphore()
+		sem <- struct{}{}
+		defer func() { <-sem }()
+
+		return nil, generateTransformedAttachment(file, transform, path)
+	})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func generateTransformedAttachment(file models.Attachment, transform AttachmentTransform, path string) error {
+	src, err := fs.DownloadFileToLocal(file, file.Destination)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve file content: %v", err)
+	}
+	if viper.GetString(fmt.Sprintf("destinations.%d.type", file.Destination)) != models.DestinationTypeLocal {
+		defer os.Remove(src)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	im, err := decodeImageFile(ctx, file, src, os.TempDir())
+	if err != nil {
+		return err
+	}
+
+	out := transformImage(im, transform)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create cache dir: %v", err)
+	}
+	// Write to a temporary name first, the readers won't see the half written file
+	tmp := path + ".tmp." + transform.Format
+	defer os.Remove(tmp)
+	if err := encodeTransformedImage(out, transform, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// transformImage resizes the image by the fit mode, the image won't be upscaled
+func transformImage(im image.Image, transform AttachmentTransform) image.Image {
+	bounds := im.Bounds()
+	srcW, srcH := float64(bounds.Dx()), float64(bounds.Dy())
+	boxW, boxH := float64(transform.Width), float64(transform.Height)
+	if boxW == 0 && boxH == 0 {
+		return im
+	}
+
+	crop := bounds
+	var dstW, dstH float64
+	switch transform.Fit {
+	case AttachmentTransformFitFill:
+		dstW, dstH = math.Min(boxW, srcW), math.Min(boxH, srcH)
+	case AttachmentTransformFitCover:
+		scale := math.Min(1, math.Max(boxW/srcW, boxH/srcH))
+		dstW, dstH = math.Min(boxW, srcW*scale), math.Min(boxH, srcH*scale)
+		// Crop the center part having the same ratio as the output
+		cropW, cropH := int(dstW/scale), int(dstH/scale)
+		x := bounds.Min.X + (bounds.Dx()-cropW)/2
+		y := bounds.Min.Y + (bounds.Dy()-cropH)/2
+		crop = image.Rect(x, y, x+cropW, y+cropH)
+	default:
+		scale := 1.0
+		if boxW > 0 {
+			scale = math.Min(scale, boxW/srcW)
+		}
+		if boxH > 0 {
+			scale = math.Min(scale, boxH/srcH)
+		}
+		dstW, dstH = srcW*scale, srcH*scale
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, max(1, int(math.Round(dstW))), max(1, int(math.Round(dstH)))))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), im, crop, draw.Src, nil)
+	return dst
+}
+
+func encodeTransformedImage(im image.Image, transform AttachmentTransform, path string) error {
+	switch transform.Format {
+	case "jpeg", "png":
+		out, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("unable to create file: %v", err)
+		}
+		defer out.Close()
+		if transform.Format == "jpeg" {
+			err = jpeg.Encode(out, im, &jpeg.Options{Quality: transform.Quality})
+		} else {
+			err = png.Encode(out, im)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to encode image: %v", err)
+		}
+		return nil
+	default:
+		// The modern formats are encoded by the external encoders from the lossless png
+		idx := slices.IndexFunc(compressedFormats, func(item compressedFormat) bool {
+			return item.Ext == "."+transform.Format
+		})
+		if idx < 0 {
+			return fmt.Errorf("unsupported format %s", transform.Format)
+		}
+		format := compressedFormats[idx]
+
+		intermediate := path + ".png"
+		defer os.Remove(intermediate)
+		if err := encodeTransformedImage(im, AttachmentTransform{Format: "png"}, intermediate); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if _, err := runToolCommand(ctx, format.Tool, format.Args(transform.Quality, intermediate, path)...); err != nil {
+			return fmt.Errorf("unable to encode image: %v", err)
+		}
+		return nil
+	}
+}
+
+// DoTransformCacheCleanup removes the variants haven't been used for a while
+func DoTransformCacheCleanup() {
+	ttl := viper.GetDuration("transforms.cache_ttl")
+	if ttl <= 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	deadline := time.Now().Add(-ttl)
+
+	var count int
+	_ = filepath.WalkDir(getTransformCachePath(), func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(deadline) {
+			if os.Remove(path) == nil {
+				count++
+			}
+		}
+		return nil
+	})
+	log.Debug().Int("affected", count).Msg("Clean up outdated transformed images accomplished.")
+}
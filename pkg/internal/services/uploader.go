@@ -38,6 +38,8 @@ func UploadFileToTemporary(ctx *fiber.Ctx, file *multipart.FileHeader, meta mode
 func ReUploadFile(meta models.Attachment, dst int, doNotUpdate ...bool) error {
 	if meta.Destination == dst {
 		return fmt.Errorf("destnation cannot be reversed temporary or the same as the original")
+	} else if meta.IsQuarantined {
+		return fmt.Errorf("attachment was quarantined, unable to move it out of temporary storage")
 	}
 
 	prevDst := meta.Destination
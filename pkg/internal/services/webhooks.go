@@ -0,0 +1,301 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/database"
+	"git.solsynth.dev/hypernet/paperclip/pkg/internal/models"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// The addresses inside these ranges are not reachable from the internet, delivering to them would let the users probe our network
+var webhookDeniedNetworks = lo.Map([]string{
+	"0.0.0.0/8",     // This network
+	"100.64.0.0/10", // Carrier-grade NAT
+	"198.18.0.0/15", // Benchmarking
+	"64:ff9b::/96",  // NAT64, maps to the IPv4 addresses
+}, func(item string, _ int) *net.IPNet {
+	_, network, _ := net.ParseCIDR(item)
+	return network
+})
+
+func isWebhookAddressAllowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	return !lo.ContainsBy(webhookDeniedNetworks, func(item *net.IPNet) bool {
+		return item.Contains(ip)
+	})
+}
+
+// The dialer checks the address actually connecting, so the redirects and the DNS rebinding cannot reach the internal network either
+var webhookDialer = &net.Dialer{
+	Timeout: 5 * time.Second,
+	Control: func(network, address string, conn syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isWebhookAddressAllowed(ip) {
+			return fmt.Errorf("webhook address %s is not allowed", host)
+		}
+		return nil
+	},
+}
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// No proxy, the dialer must see the address of the receiver
+		Proxy:               nil,
+		DialContext:         webhookDialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		} else if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s is not allowed", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// ValidateWebhookUrl checks the url is http or https, and its host resolves to the public addresses only
+func ValidateWebhookUrl(raw string) error {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %v", err)
+	} else if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("webhook url must be http or https")
+	} else if len(target.Hostname()) == 0 {
+		return fmt.Errorf("webhook url must have a host")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, target.Hostname())
+	if err != nil {
+		return fmt.Errorf("unable to resolve webhook host: %v", err)
+	}
+	for _, addr := range addrs {
+		if !isWebhookAddressAllowed(addr.IP) {
+			return fmt.Errorf("webhook host resolves to %s, which is not allowed", addr.IP)
+		}
+	}
+	return nil
+}
+
+func ListWebhookByUser(userId uint) ([]models.AttachmentWebhook, error) {
+	var webhooks []models.AttachmentWebhook
+	if err := database.C.Where("account_id = ?", userId).Preload("Pool").Find(&webhooks).Error; err != nil {
+		return webhooks, err
+	}
+	return webhooks, nil
+}
+
+func GetWebhookWithUser(id uint, userId uint) (models.AttachmentWebhook, error) {
+	var webhook models.AttachmentWebhook
+	if err := database.C.Where("id = ? AND account_id = ?", id, userId).Preload("Pool").First(&webhook).Error; err != nil {
+		return webhook, err
+	}
+	return webhook, nil
+}
+
+func NewWebhook(webhook models.AttachmentWebhook) (models.AttachmentWebhook, error) {
+	if err := ValidateWebhookUrl(webhook.Url); err != nil {
+		return webhook, err
+	}
+	if len(webhook.Secret) == 0 {
+		webhook.Secret = RandString(32)
+	}
+	if err := database.C.Save(&webhook).Error; err != nil {
+		return webhook, err
+	}
+	return webhook, nil
+}
+
+func UpdateWebhook(webhook models.AttachmentWebhook) (models.AttachmentWebhook, error) {
+	if err := ValidateWebhookUrl(webhook.Url); err != nil {
+		return webhook, err
+	}
+	if err := database.C.Save(&webhook).Error; err != nil {
+		return webhook, err
+	}
+	return webhook, nil
+}
+
+func DeleteWebhook(webhook models.AttachmentWebhook) (models.AttachmentWebhook, error) {
+	if err := database.C.Delete(&webhook).Error; err != nil {
+		return webhook, err
+	}
+	return webhook, nil
+}
+
+func CountWebhookDeliveries(webhookId uint) (int64, error) {
+	var count int64
+	if err := database.C.
+		Model(&models.AttachmentWebhookDelivery{}).
+		Where("webhook_id = ?", webhookId).
+		Count(&count).Error; err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+func ListWebhookDeliveries(webhookId uint, take, offset int) ([]models.AttachmentWebhookDelivery, error) {
+	var deliveries []models.AttachmentWebhookDelivery
+	if err := database.C.
+		Where("webhook_id = ?", webhookId).
+		Order("created_at DESC").
+		Limit(take).Offset(offset).
+		Find(&deliveries).Error; err != nil {
+		return deliveries, err
+	}
+	return deliveries, nil
+}
+
+// SignWebhookPayload signs the payload with the secret of the webhook
+// The receiver should compute HMAC-SHA256 of "<timestamp>.<body>" and compare it with the signature header
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeliverAttachmentWebhooks sends the event to all the webhooks subscribed it
+func DeliverAttachmentWebhooks(event AttachmentEvent) {
+	tx := database.C.Where("is_active = ?", true)
+	if event.PoolID != nil {
+		tx = tx.Where("(account_id = ? AND pool_id IS NULL) OR pool_id = ?", event.AccountID, *event.PoolID)
+	} else {
+		tx = tx.Where("account_id = ? AND pool_id IS NULL", event.AccountID)
+	}
+
+	var webhooks []models.AttachmentWebhook
+	if err := tx.Find(&webhooks).Error; err != nil {
+		log.Error().Err(err).Msg("Unable to find webhooks to deliver...")
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if len(webhook.Events) > 0 && !lo.Contains(webhook.Events, event.Type) {
+			continue
+		}
+		DeliverWebhook(webhook, event)
+	}
+}
+
+// DeliverWebhook logs the delivery of the event and enqueues the job sending it
+// The job queue retries it with exponential backoff, the failed deliveries will be kept as the dead jobs
+func DeliverWebhook(webhook models.AttachmentWebhook, event AttachmentEvent) {
+	var payload map[string]any
+	raw, _ := jsoniter.Marshal(event)
+	_ = jsoniter.Unmarshal(raw, &payload)
+
+	delivery := models.AttachmentWebhookDelivery{
+		Event:     event.Type,
+		Payload:   payload,
+		WebhookID: webhook.ID,
+	}
+	if err := database.C.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&delivery).Error; err != nil {
+			return err
+		}
+		job, err := EnqueueJob(tx, models.JobTypeWebhook, nil, map[string]any{
+			"delivery": delivery.ID,
+		}, models.JobPriorityBackground)
+		if err != nil {
+			return err
+		}
+		if val := viper.GetInt("webhooks.max_attempts"); val > 0 {
+			return tx.Model(&job).Update("max_attempts", val).Error
+		}
+		return nil
+	}); err != nil {
+		log.Error().Err(err).Uint("webhook", webhook.ID).Msg("Unable to enqueue webhook delivery...")
+	}
+}
+
+// SendWebhookDelivery makes one attempt of the delivery, the result will be logged into the delivery record
+func SendWebhookDelivery(deliveryId uint, attempt int) error {
+	var delivery models.AttachmentWebhookDelivery
+	if err := database.C.Where("id = ?", deliveryId).Preload("Webhook").First(&delivery).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return fmt.Errorf("unable to get webhook delivery: %v", err)
+	} else if delivery.DeliveredAt != nil {
+		// Already delivered by the previous attempt
+		return nil
+	} else if delivery.Webhook.ID == 0 || !delivery.Webhook.IsActive {
+		// The webhook was deleted or disabled after the event
+		return nil
+	}
+
+	body, _ := jsoniter.Marshal(map[string]any{
+		"id":    delivery.ID,
+		"event": delivery.Event,
+		"data":  delivery.Payload,
+	})
+
+	status, err := sendWebhookRequest(delivery.Webhook, delivery.Event, delivery.ID, body)
+	delivery.Attempts = attempt
+	delivery.StatusCode = status
+	if err == nil {
+		delivery.Error = ""
+		delivery.DeliveredAt = lo.ToPtr(time.Now())
+	} else {
+		delivery.Error = err.Error()
+	}
+	database.C.Omit("Webhook").Save(&delivery)
+
+	return err
+}
+
+func sendWebhookRequest(webhook models.AttachmentWebhook, event string, deliveryId uint, body []byte) (int, error) {
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Hypernet.Paperclip")
+	req.Header.Set("X-Paperclip-Event", event)
+	req.Header.Set("X-Paperclip-Delivery", strconv.Itoa(int(deliveryId)))
+	req.Header.Set("X-Paperclip-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Paperclip-Signature", SignWebhookPayload(webhook.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("unable to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The response body won't be kept, only drain a little to reuse the connection
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
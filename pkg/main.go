@@ -73,14 +73,20 @@ func main() {
 		log.Fatal().Err(err).Msg("An error occurred when initializing cache.")
 	}
 
+	// Configure the malware scanner
+	services.ConfigureFileScanner()
+
 	// Set up some workers
 	for idx := 0; idx < viper.GetInt("workers.files_analyze"); idx++ {
-		go services.StartConsumeAnalyzeTask()
+		go services.StartConsumeJobs(fmt.Sprintf("%s#%d", viper.GetString("id"), idx))
 	}
 
 	// Configure timed tasks
 	quartz := cron.New(cron.WithLogger(cron.VerbosePrintfLogger(&log.Logger)))
 	quartz.AddFunc("@every 60m", services.DoAutoDatabaseCleanup)
+	quartz.AddFunc("@every 60m", services.DoJobQueueCleanup)
+	quartz.AddFunc("@every 60m", services.DoTransformCacheCleanup)
+	quartz.AddFunc("@every 60m", services.DoPlaceholderBackfill)
 	quartz.AddFunc("@every 60m", fs.RunMarkLifecycleDeletionTask)
 	quartz.AddFunc("@every 60m", fs.RunMarkMultipartDeletionTask)
 	quartz.AddFunc("@midnight", fs.RunScheduleDeletionTask)
@@ -94,7 +100,6 @@ func main() {
 
 	// Post-boot actions
 	services.BuildDestinationMapping()
-	services.ScanUnanalyzedFileFromDatabase()
 	fs.RunMarkLifecycleDeletionTask()
 
 	// Messages